@@ -0,0 +1,34 @@
+#!/bin/sh
+# Usage: smoke-test.sh <url> <health path> <timeout seconds> [<path>=<status>...]
+url="$1"
+health="$2"
+timeout="$3"
+deadline=$(($(date +%s) + timeout))
+shift 3
+
+status_of() {
+	curl --silent --output /dev/null --max-time 5 --write-out '%{http_code}' "$url$1"
+}
+
+until [ "$(status_of "$health")" = 200 ]; do
+	if [ "$(date +%s)" -ge "$deadline" ]; then
+		echo "$health did not return 200 within $timeout seconds"
+		exit 1
+	fi
+	sleep 1
+done
+echo "ok $health 200"
+
+failed=0
+for probe in "$@"; do
+	path="${probe%=*}"
+	want="${probe##*=}"
+	got="$(status_of "$path")"
+	if [ "$got" = "$want" ]; then
+		echo "ok $path $got"
+	else
+		echo "failed $path: expected $want, got $got"
+		failed=1
+	fi
+done
+exit $failed
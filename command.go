@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Command line built from typed arguments, executed without a shell
+type command struct {
+	args []string
+	err  error
+}
+
+func newCommand(
+	name string,
+	args ...string,
+) *command {
+	return &command{args: append([]string{name}, args...)}
+}
+
+// Append literal arguments
+func (c *command) with(
+	args ...string,
+) *command {
+	c.args = append(c.args, args...)
+	return c
+}
+
+// Append --flag=value, if value is set
+func (c *command) withFlag(
+	flag string,
+	value string,
+) *command {
+	if value != "" {
+		c.args = append(c.args, fmt.Sprintf("--%s=%s", flag, value))
+	}
+	return c
+}
+
+// Append --flag, if set
+func (c *command) withBool(
+	flag string,
+	set bool,
+) *command {
+	if set {
+		c.args = append(c.args, "--"+flag)
+	}
+	return c
+}
+
+// Append arguments parsed by shell-word rules
+func (c *command) withShellWords(
+	s string,
+) *command {
+	words, err := shellWords(s)
+	if err != nil {
+		return c.fail(err)
+	}
+	c.args = append(c.args, words...)
+	return c
+}
+
+// Record a validation error, the first one is kept
+func (c *command) fail(
+	err error,
+) *command {
+	if c.err == nil {
+		c.err = err
+	}
+	return c
+}
+
+// Arguments for WithExec, or the first validation error
+func (c *command) build() ([]string, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.args, nil
+}
+
+// Split a string into words like a POSIX shell would, without expansion.
+// Unquoted operators and expansions are rejected instead of being passed on.
+func shellWords(
+	s string,
+) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	for i := 0; i < len(s); i++ {
+		r := rune(s[i])
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(s[i])
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				if i+1 < len(s) && strings.ContainsRune("\"\\$`", rune(s[i+1])) {
+					i++
+				}
+				word.WriteByte(s[i])
+			case '$', '`':
+				return nil, fmt.Errorf("unsupported expansion %q in %q, escape or single quote it", r, s)
+			default:
+				word.WriteByte(s[i])
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\':
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("trailing backslash in %q", s)
+			}
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case strings.ContainsRune(";&|<>()", r):
+			return nil, fmt.Errorf("unquoted shell operator %q in %q, quote it to pass it literally", r, s)
+		case r == '$' || r == '`':
+			return nil, fmt.Errorf("unsupported expansion %q in %q, escape or single quote it", r, s)
+		default:
+			word.WriteByte(s[i])
+			inWord = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+var (
+	dnsLabel   = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	identifier = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	k8sVersion = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+)
+
+// Validate a Kubernetes name, e.g. a namespace or Helm release
+func validateDnsLabel(
+	kind string,
+	value string,
+) error {
+	if len(value) > 63 || !dnsLabel.MatchString(value) {
+		return fmt.Errorf("invalid %s %q: must consist of lower case alphanumeric characters or '-', start and end with an alphanumeric character, and be at most 63 characters", kind, value)
+	}
+	return nil
+}
+
+// Validate a name like a NuGet source or build configuration
+func validateIdentifier(
+	kind string,
+	value string,
+) error {
+	if !identifier.MatchString(value) {
+		return fmt.Errorf("invalid %s %q: must consist of alphanumeric characters, '.', '_' or '-', and start with an alphanumeric character", kind, value)
+	}
+	return nil
+}
+
+// Validate an absolute http(s) URL
+func validateUrl(
+	kind string,
+	value string,
+) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(value, " \t\n'\"`$;|&<>") {
+		return fmt.Errorf("invalid %s %q: must be an absolute http or https URL", kind, value)
+	}
+	return nil
+}
+
+// Validate a duration like 300s or 5m
+func validateDuration(
+	kind string,
+	value string,
+) error {
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Errorf("invalid %s %q: must be a duration like 300s or 5m", kind, value)
+	}
+	return nil
+}
+
+// Validate a Kubernetes minor version like 1.29
+func validateKubernetesVersion(
+	value string,
+) error {
+	if !k8sVersion.MatchString(value) {
+		return fmt.Errorf("invalid Kubernetes version %q: must be <major>.<minor>, e.g. 1.29", value)
+	}
+	return nil
+}
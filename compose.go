@@ -3,17 +3,42 @@ package main
 import (
 	"context"
 	"dagger/mikael-elkiaer/internal/dagger"
-	_ "embed"
-)
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
 
-//go:embed assets/update_images.bash
-var script string
+	"github.com/Masterminds/semver/v3"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
+)
 
 type Compose struct {
 	// Current state
 	Container *dagger.Container
 }
 
+// Updated Docker Compose file with a per-service change report
+type ComposeUpdate struct {
+	// Updated Docker Compose file
+	File *dagger.File
+	// Outcome for every service with an image
+	Changes []*ImageChange
+}
+
+// Image update of a single service
+type ImageChange struct {
+	// Name of the service
+	Service string
+	// Image before the update
+	From string
+	// Image after the update, empty if skipped
+	To string
+	// Why the image was not updated, empty if updated
+	SkippedReason string
+}
+
 // Submodule for Docker Compose
 func (m *MikaelElkiaer) Compose(
 	ctx context.Context,
@@ -27,15 +52,460 @@ func (m *Compose) UpdateImages(
 	ctx context.Context,
 	// Docker Compose file
 	file *dagger.File,
-) *dagger.File {
-	c := m.Container.
-		WithNewFile("script.bash", script).
-		WithFile("docker-compose.yaml", file).
-		WithExec(inSh("bash", "script.bash"))
+	// Pin images as repo:tag@sha256:...
+	// Images that already have a digest are always kept in sync
+	// +default=false
+	pinDigests bool,
+	// Pin the digest of a single platform, e.g. linux/arm64, instead of the multi-arch index
+	// Defaults to the platform of an existing digest, if any
+	// +optional
+	platform string,
+	// Update policy: patch, minor, major, or an explicit SemVer range, e.g. ">=16 <18"
+	// minor keeps 0.x versions within their minor, like a caret range
+	// Overridden per service by an x-update-policy field or an update-policy label
+	// +default="minor"
+	policy string,
+) (*ComposeUpdate, error) {
+	if platform != "" {
+		if _, err := parsePlatform(platform); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := policyConstraint(policy, semver.New(0, 0, 0, "", "")); err != nil {
+		return nil, err
+	}
+
+	name, err := file.Name(ctx)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := file.Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := composeImages(contents)
+	if err != nil {
+		return nil, err
+	}
 
-	f := c.File("docker-compose.yaml")
+	// Tags change upstream, so never reuse a cached listing
+	c := m.Container.WithEnvVariable("CACHE_BUST", time.Now().String())
 
-	return f
+	changes := make([]*ImageChange, len(images))
+	eg, gctx := errgroup.WithContext(ctx)
+	for i, image := range images {
+		eg.Go(func() error {
+			change, err := updateImage(gctx, c, image, pinDigests, platform, policy)
+			changes[i] = change
+			return err
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(contents, "\n")
+	for i, change := range changes {
+		if change.To == "" {
+			continue
+		}
+		if err := replaceScalar(lines, images[i].node, change.To); err != nil {
+			return nil, err
+		}
+	}
+
+	return &ComposeUpdate{
+		File:    dag.File(name, strings.Join(lines, "\n")),
+		Changes: changes,
+	}, nil
+}
+
+// Image of a service, with its position in the compose file
+type composeImage struct {
+	service string
+	node    *yaml.Node
+	// Update policy override for the service, if any
+	policy string
+}
+
+func composeImages(
+	contents string,
+) ([]*composeImage, error) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal([]byte(contents), &doc); err != nil {
+		return nil, fmt.Errorf("parsing compose file: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	images := []*composeImage{}
+	services := mappingValue(doc.Content[0], "services")
+	if services == nil || services.Kind != yaml.MappingNode {
+		return images, nil
+	}
+	for i := 0; i+1 < len(services.Content); i += 2 {
+		service := services.Content[i+1]
+		image := mappingValue(service, "image")
+		if image == nil || image.Kind != yaml.ScalarNode {
+			continue
+		}
+		images = append(images, &composeImage{
+			service: services.Content[i].Value,
+			node:    image,
+			policy:  servicePolicy(service),
+		})
+	}
+	return images, nil
+}
+
+// Policy from x-update-policy, or the update-policy label in map or list form
+func servicePolicy(
+	service *yaml.Node,
+) string {
+	if policy := mappingValue(service, "x-update-policy"); policy != nil && policy.Kind == yaml.ScalarNode {
+		return policy.Value
+	}
+
+	labels := mappingValue(service, "labels")
+	if labels == nil {
+		return ""
+	}
+	switch labels.Kind {
+	case yaml.MappingNode:
+		if policy := mappingValue(labels, "update-policy"); policy != nil && policy.Kind == yaml.ScalarNode {
+			return policy.Value
+		}
+	case yaml.SequenceNode:
+		for _, label := range labels.Content {
+			if policy, ok := strings.CutPrefix(label.Value, "update-policy="); ok {
+				return policy
+			}
+		}
+	}
+	return ""
+}
+
+// Constraint for a policy relative to the current version
+func policyConstraint(
+	policy string,
+	current *semver.Version,
+) (*semver.Constraints, error) {
+	var constraint string
+	switch policy {
+	case "patch":
+		constraint = fmt.Sprintf(">=%s, <%d.%d.0", current, current.Major(), current.Minor()+1)
+	case "minor":
+		// Like a caret range, a 0.x minor may break, so it stays within the minor
+		if current.Major() == 0 {
+			constraint = fmt.Sprintf(">=%s, <0.%d.0", current, current.Minor()+1)
+		} else {
+			constraint = fmt.Sprintf(">=%s, <%d.0.0", current, current.Major()+1)
+		}
+	case "major":
+		constraint = fmt.Sprintf(">=%s", current)
+	default:
+		constraint = policy
+	}
+
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid update policy %q: must be patch, minor, major, or a SemVer range: %w", policy, err)
+	}
+	return c, nil
+}
+
+func mappingValue(
+	node *yaml.Node,
+	key string,
+) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Replace a scalar in place, keeping the rest of the file untouched
+func replaceScalar(
+	lines []string,
+	node *yaml.Node,
+	value string,
+) error {
+	line := lines[node.Line-1]
+	start := node.Column - 1
+	if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 {
+		start++
+	}
+	if start > len(line) || !strings.HasPrefix(line[start:], node.Value) {
+		return fmt.Errorf("image %s not found at line %d", node.Value, node.Line)
+	}
+	lines[node.Line-1] = line[:start] + value + line[start+len(node.Value):]
+	return nil
+}
+
+func updateImage(
+	ctx context.Context,
+	container *dagger.Container,
+	image *composeImage,
+	pinDigests bool,
+	platform string,
+	policy string,
+) (*ImageChange, error) {
+	change := &ImageChange{Service: image.service, From: image.node.Value}
+
+	if strings.Contains(image.node.Value, "$") {
+		change.SkippedReason = "image uses variable interpolation"
+		return change, nil
+	}
+	ref, err := parseImageRef(image.node.Value)
+	if err != nil {
+		change.SkippedReason = err.Error()
+		return change, nil
+	}
+	if ref.Tag == "" {
+		change.SkippedReason = "no tag"
+		return change, nil
+	}
+	pin := pinDigests || ref.Digest != ""
+
+	latest := ref.Tag
+	skippedReason := "up to date"
+	current, ok := parseTagVersion(ref.Tag)
+	if ok {
+		tags, err := listTags(ctx, container, ref)
+		if err != nil {
+			change.SkippedReason = fmt.Sprintf("listing tags failed: %s", err)
+			return change, nil
+		}
+
+		if image.policy != "" {
+			policy = image.policy
+		}
+		constraint, err := policyConstraint(policy, current.version)
+		if err != nil {
+			change.SkippedReason = err.Error()
+			return change, nil
+		}
+		latest = selectTag(ref.Tag, current, tags, constraint)
+	} else {
+		skippedReason = fmt.Sprintf("tag %s is not a version", ref.Tag)
+	}
+
+	digest := ""
+	if pin {
+		if platform == "" && ref.Digest != "" {
+			platform, err = platformOfDigest(ctx, container, ref)
+			if err != nil {
+				change.SkippedReason = fmt.Sprintf("inspecting digest failed: %s", err)
+				return change, nil
+			}
+		}
+		digest, err = resolveDigest(ctx, container, ref.repository()+":"+latest, platform)
+		if err != nil {
+			change.SkippedReason = fmt.Sprintf("resolving digest failed: %s", err)
+			return change, nil
+		}
+	}
+
+	if latest == ref.Tag && digest == ref.Digest {
+		change.SkippedReason = skippedReason
+		return change, nil
+	}
+
+	change.To = ref.with(latest, digest)
+	return change, nil
+}
+
+func listTags(
+	ctx context.Context,
+	container *dagger.Container,
+	ref *imageRef,
+) ([]string, error) {
+	out, err := container.
+		WithExec([]string{"skopeo", "list-tags", "docker://" + ref.repository()}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := struct {
+		Tags []string
+	}{}
+	if err := json.Unmarshal([]byte(out), &listed); err != nil {
+		return nil, fmt.Errorf("unexpected output from skopeo: %w", err)
+	}
+	return listed.Tags, nil
+}
+
+// Manifest or multi-arch index, as returned by skopeo inspect --raw
+type imageManifest struct {
+	MediaType string `json:"mediaType"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			Os           string `json:"os"`
+			Architecture string `json:"architecture"`
+			Variant      string `json:"variant"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+func inspectManifest(
+	ctx context.Context,
+	container *dagger.Container,
+	image string,
+) (*imageManifest, error) {
+	out, err := container.
+		WithExec([]string{"skopeo", "inspect", "--raw", "docker://" + image}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &imageManifest{}
+	if err := json.Unmarshal([]byte(out), manifest); err != nil {
+		return nil, fmt.Errorf("unexpected output from skopeo: %w", err)
+	}
+	return manifest, nil
+}
+
+// Digest of the image, or of a single platform in its multi-arch index
+func resolveDigest(
+	ctx context.Context,
+	container *dagger.Container,
+	image string,
+	platform string,
+) (string, error) {
+	if platform != "" {
+		manifest, err := inspectManifest(ctx, container, image)
+		if err != nil {
+			return "", err
+		}
+		if len(manifest.Manifests) > 0 {
+			p, err := parsePlatform(platform)
+			if err != nil {
+				return "", err
+			}
+			for _, m := range manifest.Manifests {
+				if m.Platform.Os == p.os && m.Platform.Architecture == p.architecture && (p.variant == "" || m.Platform.Variant == p.variant) {
+					return m.Digest, nil
+				}
+			}
+			return "", fmt.Errorf("platform %s not found for %s", platform, image)
+		}
+	}
+
+	// Digest of the top-level manifest, i.e. the index for multi-arch images
+	out, err := container.
+		WithExec([]string{"skopeo", "inspect", "--format", "{{.Digest}}", "docker://" + image}).
+		Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Platform an existing digest was pinned to, empty if it is the index itself
+func platformOfDigest(
+	ctx context.Context,
+	container *dagger.Container,
+	ref *imageRef,
+) (string, error) {
+	manifest, err := inspectManifest(ctx, container, ref.repository()+":"+ref.Tag)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range manifest.Manifests {
+		if m.Digest == ref.Digest {
+			p := m.Platform.Os + "/" + m.Platform.Architecture
+			if m.Platform.Variant != "" {
+				p += "/" + m.Platform.Variant
+			}
+			return p, nil
+		}
+	}
+	return "", nil
+}
+
+type imagePlatform struct {
+	os           string
+	architecture string
+	variant      string
+}
+
+func parsePlatform(
+	s string,
+) (*imagePlatform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q: must be os/arch[/variant], e.g. linux/arm64", s)
+	}
+	p := &imagePlatform{os: parts[0], architecture: parts[1]}
+	if len(parts) == 3 {
+		p.variant = parts[2]
+	}
+	return p, nil
+}
+
+// Version in a tag, e.g. v1.2.3 or 16.2-alpine
+type tagVersion struct {
+	// Prefix before the version, e.g. v
+	prefix string
+	// Number of version components, e.g. 2 for 16.2
+	parts   int
+	version *semver.Version
+	// Suffix after the version, e.g. -alpine, must match to be a candidate
+	suffix string
+}
+
+var tagVersionPattern = regexp.MustCompile(`^([vV]?)([0-9]+(?:\.[0-9]+){0,2})(-.+)?$`)
+
+func parseTagVersion(
+	tag string,
+) (*tagVersion, bool) {
+	match := tagVersionPattern.FindStringSubmatch(tag)
+	if match == nil {
+		return nil, false
+	}
+	version, err := semver.NewVersion(match[2])
+	if err != nil {
+		return nil, false
+	}
+	return &tagVersion{
+		prefix:  match[1],
+		parts:   strings.Count(match[2], ".") + 1,
+		version: version,
+		suffix:  match[3],
+	}, true
+}
+
+// Newest tag of the same shape as current satisfying the constraint,
+// or the current tag if none is newer
+func selectTag(
+	currentTag string,
+	current *tagVersion,
+	tags []string,
+	constraint *semver.Constraints,
+) string {
+	best := current
+	bestTag := currentTag
+	for _, tag := range tags {
+		candidate, ok := parseTagVersion(tag)
+		if !ok || candidate.prefix != current.prefix || candidate.suffix != current.suffix || candidate.parts != current.parts {
+			continue
+		}
+		if !constraint.Check(candidate.version) || !candidate.version.GreaterThan(best.version) {
+			continue
+		}
+		best = candidate
+		bestTag = tag
+	}
+	return bestTag
 }
 
 func (m *MikaelElkiaer) compose(
@@ -43,15 +513,14 @@ func (m *MikaelElkiaer) compose(
 ) *dagger.Container {
 	c := dag.Container().
 		From("docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b").
-		WithExec(inSh("apk add bash=5.2.21-r0 npm=10.2.5-r0 skopeo=1.14.0-r2 yq=4.35.2-r3")).
-		WithExec(inSh("npm install --global semver@7.6.2"))
+		WithExec([]string{"apk", "add", "--no-cache", "skopeo"})
 
 	for _, cred := range m.Creds {
 		c = c.WithRegistryAuth("ghcr.io", cred.UserId, cred.UserSecret).
 			WithEnvVariable("__URL", cred.Url).
 			WithEnvVariable("__USERNAME", cred.UserId).
 			WithSecretVariable("__PASSWORD", cred.UserSecret).
-			WithExec(inSh("echo $__PASSWORD | skopeo login --username $__USERNAME --password-stdin $__URL")).
+			WithExec(inSh(`echo "$__PASSWORD" | skopeo login --username "$__USERNAME" --password-stdin "$__URL"`)).
 			WithoutSecretVariable("__PASSWORD").
 			WithoutEnvVariable("__USERNAME").
 			WithoutEnvVariable("__URL")
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"dagger/mikael-elkiaer/internal/dagger"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const COVERAGEDIR = "/coverage"
+
+// Line coverage of a single assembly
+type AssemblyCoverage struct {
+	// Name of the assembly
+	Name string
+	// Line coverage in percent
+	LineCoverage float64
+}
+
+// Merge per-project Cobertura reports into one Cobertura and an HTML report
+func (m *Dotnet) mergeCoverage(
+	ctx context.Context,
+	results *dagger.Directory,
+	r *TestResults,
+) error {
+	reports, err := results.Glob(ctx, "**/coverage.cobertura.xml")
+	if err != nil {
+		return err
+	}
+	if len(reports) == 0 {
+		r.Coverage = dag.Directory()
+		return nil
+	}
+
+	coverage := m.Base.
+		WithExec([]string{"dotnet", "tool", "install", "--tool-path", "/root/tools", "dotnet-reportgenerator-globaltool", "--version", "5.4.4"}).
+		WithMountedDirectory(TESTRESULTSDIR, results).
+		WithExec([]string{"/root/tools/reportgenerator", "-reports:" + TESTRESULTSDIR + "/**/coverage.cobertura.xml", "-targetdir:" + COVERAGEDIR, "-reporttypes:Cobertura;Html"}).
+		Directory(COVERAGEDIR)
+
+	contents, err := coverage.File("Cobertura.xml").Contents(ctx)
+	if err != nil {
+		return err
+	}
+	report := &coberturaReport{}
+	if err := xml.Unmarshal([]byte(contents), report); err != nil {
+		return fmt.Errorf("parsing merged coverage: %w", err)
+	}
+
+	r.Coverage = coverage
+	r.LineCoverage = report.LineRate * 100
+	r.CoverageByAssembly = []*AssemblyCoverage{}
+	for _, p := range report.Packages {
+		r.CoverageByAssembly = append(r.CoverageByAssembly, &AssemblyCoverage{Name: p.Name, LineCoverage: p.LineRate * 100})
+	}
+	sort.Slice(r.CoverageByAssembly, func(i, j int) bool {
+		return r.CoverageByAssembly[i].Name < r.CoverageByAssembly[j].Name
+	})
+	return nil
+}
+
+// Error with a per-assembly breakdown if line coverage is below the threshold
+func (r *TestResults) checkCoverage() error {
+	if r.MinLineCoverage <= 0 {
+		return nil
+	}
+	if len(r.CoverageByAssembly) == 0 {
+		return fmt.Errorf("no coverage collected, expected at least %s line coverage", formatPercent(r.MinLineCoverage))
+	}
+	if r.LineCoverage >= r.MinLineCoverage {
+		return nil
+	}
+
+	lines := []string{}
+	for _, a := range r.CoverageByAssembly {
+		marker := ""
+		if a.LineCoverage < r.MinLineCoverage {
+			marker = " (below threshold)"
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s%s", a.Name, formatPercent(a.LineCoverage), marker))
+	}
+	return fmt.Errorf("line coverage %s is below %s:\n%s", formatPercent(r.LineCoverage), formatPercent(r.MinLineCoverage), strings.Join(lines, "\n"))
+}
+
+func formatPercent(
+	f float64,
+) string {
+	return strconv.FormatFloat(f, 'f', 2, 64) + "%"
+}
+
+type coberturaReport struct {
+	LineRate float64 `xml:"line-rate,attr"`
+	Packages []struct {
+		Name     string  `xml:"name,attr"`
+		LineRate float64 `xml:"line-rate,attr"`
+	} `xml:"packages>package"`
+}
@@ -1,14 +1,34 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"crypto/sha256"
 	"dagger/mikael-elkiaer/internal/dagger"
-	_ "embed"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"golang.org/x/sync/errgroup"
 )
 
-//go:embed assets/dotnet.Dockerfile
-var dotnet__Dockerfile string
+const (
+	LOCKFILE = "packages.lock.json"
+	// Global packages folder used by restore, mounted as a cache volume
+	NUGETPACKAGESCACHE = "/root/.nuget/packages"
+	// Copy of the restored packages in the workdir, so they are part of the restore layer
+	NUGETPACKAGESDIR = WORKDIR + ".packages"
+	// User-level config, merged with any nuget.config in the source
+	NUGETCONFIG    = "/root/.nuget/NuGet/NuGet.Config"
+	TESTRESULTSDIR = "/test-results"
+)
 
 type Dotnet struct {
 	// +private
@@ -20,105 +40,1023 @@ type Dotnet struct {
 	// +private
 	Module *MikaelElkiaer
 	// +private
-	EntrypointProject string
+	EntrypointProjects []string
+	// +private
+	PublishMode string
+	// +private
+	Trim bool
+	// +private
+	TrimMode string
+	// +private
+	Channel string
+	// +private
+	TestServices []*DotnetTestService
+	// +private
+	TestVariables []*DotnetTestVariable
+	// +private
+	Runtime *DotnetRuntime
+	// +private
+	Publisher *dagger.Container
+	// Results of the latest test run, also kept when tests fail
+	TestResults *TestResults
+}
+
+// Service bound to test runs
+type DotnetTestService struct {
+	// Hostname of the service
+	Name    string
+	Service *dagger.Service
+}
+
+// Environment variable set for test runs
+type DotnetTestVariable struct {
+	Name string
+	// Set if the value is not secret
+	Value string
+	// Set if the value is secret
+	Secret *dagger.Secret
 }
 
 // .NET submodule
 func (m *MikaelElkiaer) Dotnet(
 	ctx context.Context,
+	// .NET channel of the SDK, e.g. 8.0
+	// Defaults to global.json, rolled forward as it allows, or the newest target framework
+	// +optional
+	channel string,
 	// Configuration to use for commands
 	// +default="Release"
 	configuration string,
 	// Name of the entrypoint project
+	// +optional
 	entrypointProject string,
+	// Names of additional entrypoint projects, each published to its own directory
+	// +optional
+	entrypointProjects []string,
 	// Solution directory
 	source *dagger.Directory,
-) *Dotnet {
+) (*Dotnet, error) {
+	if err := validateIdentifier("configuration", configuration); err != nil {
+		return nil, err
+	}
+	projects := []string{}
+	for _, project := range append([]string{entrypointProject}, entrypointProjects...) {
+		if project == "" || slices.Contains(projects, project) {
+			continue
+		}
+		if err := validateIdentifier("entrypoint project", project); err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+
+	global, err := globalJson(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	frameworks, err := targetFrameworks(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	channel, err = sdkChannel(channel, global, frameworks)
+	if err != nil {
+		return nil, err
+	}
+	images, err := channelImages(channel)
+	if err != nil {
+		return nil, err
+	}
+
 	c := dag.Container().
-		From("mcr.microsoft.com/dotnet/sdk:10.0-alpine@sha256:940f919ae84dd92ccd4aab7686fa5b777870b006c9360351039e16bcaad73d89").
+		From(images.sdk).
 		WithExec(inSh(`apk add --no-cache bash`)).
 		WithWorkdir("/src").
-		WithExec(inSh("dotnet new nugetconfig --output /root/nuget/"))
+		WithExec([]string{"dotnet", "new", "nugetconfig", "--output", path.Dir(NUGETCONFIG)}).
+		WithExec([]string{"mv", path.Join(path.Dir(NUGETCONFIG), "nuget.config"), NUGETCONFIG}).
+		WithEnvVariable("NUGET_PACKAGES", NUGETPACKAGESDIR)
 
-	return &Dotnet{Base: c, Configuration: configuration, Container: c.WithDirectory(WORKDIR, source), Module: m, EntrypointProject: entrypointProject}
+	return &Dotnet{Base: c, Configuration: configuration, Container: c.WithDirectory(WORKDIR, source), Module: m, EntrypointProjects: projects, PublishMode: "framework-dependent", Channel: channel, Publisher: publishContainer()}, nil
 }
 
 // Restore dependencies
+//
+// Packages are cached in a volume keyed by the lock files and
+// Directory.Packages.props, restoring in locked mode if there are lock files.
+// The restored packages are copied into the workdir for the later steps.
 func (m *Dotnet) Restore(
 	ctx context.Context,
 	// Pattern to match the csproj files
 	// +default="**/*.csproj"
 	csproj string,
+	// Additional patterns of files affecting restore, e.g. **/*.targets
+	// +optional
+	include []string,
 	// Pattern to match the sln files
 	// +default="*.sln"
 	sln string,
-) *Dotnet {
+) (*Dotnet, error) {
+	source := m.Container.Directory(WORKDIR)
+	locks, err := source.Glob(ctx, "**/"+LOCKFILE)
+	if err != nil {
+		return nil, err
+	}
+	props, err := source.Glob(ctx, "**/Directory.Packages.props")
+	if err != nil {
+		return nil, err
+	}
+	key, err := fileKey(ctx, source, append(locks, props...))
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"dotnet", "restore"}
+	if len(locks) > 0 {
+		args = append(args, "--locked-mode")
+	}
+
+	// Cache mounts are not part of the layer, so copy the packages out for the steps running without restore
 	m.Container = m.Base.
-		WithDirectory(WORKDIR, m.Container.Directory(WORKDIR), dagger.ContainerWithDirectoryOpts{Include: []string{csproj}}).
-		WithDirectory(WORKDIR, m.Container.Directory(WORKDIR), dagger.ContainerWithDirectoryOpts{Include: []string{sln}}).
-		WithExec(inSh("dotnet restore --configfile /root/nuget/nuget.config --packages .packages")).
-		WithDirectory(WORKDIR, m.Container.Directory(WORKDIR))
+		WithDirectory(WORKDIR, source, dagger.ContainerWithDirectoryOpts{Include: restoreIncludes(csproj, sln, include)}).
+		WithMountedCache(NUGETPACKAGESCACHE, dag.CacheVolume("dotnet-nuget-packages-"+key)).
+		WithEnvVariable("NUGET_PACKAGES", NUGETPACKAGESCACHE).
+		WithExec(inSh(`dir=$1 && shift && "$@" && mkdir -p "$dir" && cp -a "$NUGET_PACKAGES/." "$dir"`, append([]string{NUGETPACKAGESDIR}, args...)...)).
+		WithoutMount(NUGETPACKAGESCACHE).
+		WithEnvVariable("NUGET_PACKAGES", NUGETPACKAGESDIR).
+		WithDirectory(WORKDIR, source)
 
-	return m
+	return m, nil
+}
+
+// Files affecting restore besides projects and solutions
+var restoreInputs = []string{
+	"*.slnx",
+	"global.json",
+	"**/" + LOCKFILE,
+	"**/Directory.Build.props",
+	"**/Directory.Build.targets",
+	"**/Directory.Packages.props",
+	"**/nuget.config",
+	"**/NuGet.config",
+	"**/NuGet.Config",
+}
+
+// Patterns of the files copied in before restore
+func restoreIncludes(
+	csproj string,
+	sln string,
+	include []string,
+) []string {
+	return slices.Concat([]string{csproj, sln}, restoreInputs, include)
+}
+
+// Short hash of the paths and contents of files, stable across runs
+func fileKey(
+	ctx context.Context,
+	dir *dagger.Directory,
+	files []string,
+) (string, error) {
+	slices.Sort(files)
+	h := sha256.New()
+	for _, file := range files {
+		contents, err := dir.File(file).Contents(ctx)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00", file, contents)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
 }
 
 // Build a .NET project
 func (m *Dotnet) Build(
 	ctx context.Context,
+	// Fail on compiler and analyzer warnings
+	// +default=false
+	warningsAsErrors bool,
 ) *Dotnet {
+	args := []string{"dotnet", "build", "--configuration", m.Configuration, "--no-restore"}
+	if warningsAsErrors {
+		args = append(args, "/p:TreatWarningsAsErrors=true")
+	}
 	m.Container = m.Base.
 		WithDirectory(WORKDIR, m.Container.Directory(WORKDIR)).
-		WithExec(inSh("dotnet build --configuration %s --no-restore --packages .packages", m.Configuration))
+		WithExec(args)
 
 	return m
 }
 
+// Check whitespace, style and analyzer formatting
+//
+// Fails with the diagnostics if anything would change, unless fixing.
+// Returns the source, with fixes applied if fixing.
+func (m *Dotnet) Format(
+	ctx context.Context,
+	// Apply fixes instead of failing
+	// +default=false
+	fix bool,
+	// Minimum severity of diagnostics to check or fix: info, warn or error
+	// +default="warn"
+	severity string,
+) (*dagger.Directory, error) {
+	switch severity {
+	case "info", "warn", "error":
+	default:
+		return nil, fmt.Errorf("invalid severity %q: must be info, warn or error", severity)
+	}
+
+	args := []string{"dotnet", "format", "--no-restore", "--severity", severity}
+	if !fix {
+		args = append(args, "--verify-no-changes")
+	}
+	c := m.Base.
+		WithDirectory(WORKDIR, m.Container.Directory(WORKDIR)).
+		WithExec(inSh(`"$@" 2>&1`, args...), dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	code, err := c.ExitCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		out, err := c.Stdout(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if fix {
+			return nil, fmt.Errorf("dotnet format failed:\n%s", out)
+		}
+		return nil, fmt.Errorf("formatting is not up to date, run format with fix:\n%s", out)
+	}
+
+	return dag.Directory().WithDirectory(".", c.Directory(WORKDIR), dagger.DirectoryWithDirectoryOpts{Exclude: []string{"**/bin", "**/obj", ".packages"}}), nil
+}
+
+// Run all checks: restore, format, build with warnings as errors, and test
+func (m *Dotnet) Check(
+	ctx context.Context,
+	// Minimum line coverage in percent
+	// +default=0
+	minLineCoverage float64,
+) (*TestResults, error) {
+	m, err := m.Restore(ctx, "**/*.csproj", nil, "*.sln")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.Format(ctx, false, "warn"); err != nil {
+		return nil, err
+	}
+	return m.Build(ctx, true).Test(ctx, false, true, minLineCoverage)
+}
+
+// Bind a service to test runs, e.g. a database for integration tests
+func (m *Dotnet) WithTestService(
+	ctx context.Context,
+	// Hostname to reach the service by
+	name string,
+	// Service to bind
+	service *dagger.Service,
+) (*Dotnet, error) {
+	if err := validateDnsLabel("service name", name); err != nil {
+		return nil, err
+	}
+	m.TestServices = append(m.TestServices, &DotnetTestService{Name: name, Service: service})
+	return m, nil
+}
+
+// Set an environment variable for test runs, e.g. a connection string
+func (m *Dotnet) WithTestEnvVariable(
+	ctx context.Context,
+	// Name of the variable, e.g. ConnectionStrings__Default
+	name string,
+	// Value of the variable
+	value string,
+) (*Dotnet, error) {
+	if err := validateIdentifier("environment variable", name); err != nil {
+		return nil, err
+	}
+	m.TestVariables = append(m.TestVariables, &DotnetTestVariable{Name: name, Value: value})
+	return m, nil
+}
+
+// Set a secret environment variable for test runs, e.g. a connection string with a password
+func (m *Dotnet) WithTestSecretVariable(
+	ctx context.Context,
+	// Name of the variable, e.g. ConnectionStrings__Default
+	name string,
+	// Value of the variable
+	secret *dagger.Secret,
+) (*Dotnet, error) {
+	if err := validateIdentifier("environment variable", name); err != nil {
+		return nil, err
+	}
+	m.TestVariables = append(m.TestVariables, &DotnetTestVariable{Name: name, Secret: secret})
+	return m, nil
+}
+
+// Start test services and wait for their ports, then bind them with the test variables
+func (m *Dotnet) withTestEnvironment(
+	ctx context.Context,
+	c *dagger.Container,
+) (*dagger.Container, error) {
+	eg, gctx := errgroup.WithContext(ctx)
+	for _, s := range m.TestServices {
+		eg.Go(func() error {
+			if _, err := s.Service.Start(gctx); err != nil {
+				return fmt.Errorf("service %s did not become healthy: %w", s.Name, err)
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range m.TestServices {
+		c = c.WithServiceBinding(s.Name, s.Service)
+	}
+	for _, v := range m.TestVariables {
+		if v.Secret != nil {
+			c = c.WithSecretVariable(v.Name, v.Secret)
+		} else {
+			c = c.WithEnvVariable(v.Name, v.Value)
+		}
+	}
+	return c, nil
+}
+
 // Run all available tests
+//
+// Test services are started and healthy before the tests run.
 func (m *Dotnet) Test(
 	ctx context.Context,
-) *Dotnet {
-	m.Container = m.Base.
-		WithDirectory(WORKDIR, m.Container.Directory(WORKDIR)).
-		WithExec(inSh("dotnet test --configuration %s --no-build", m.Configuration))
+	// Collect coverage with the XPlat Code Coverage collector
+	// +default=false
+	coverage bool,
+	// Fail if tests fail, listing the failing tests, otherwise check the results with assert
+	// The results are kept in TestResults either way, e.g. to publish the JUnit reports
+	// +default=true
+	failOnError bool,
+	// Minimum line coverage in percent, failing the run with the coverage per assembly if below
+	// Implies coverage
+	// +default=0
+	minLineCoverage float64,
+) (*TestResults, error) {
+	args := []string{"dotnet", "test", "--configuration", m.Configuration, "--no-build", "--logger", "trx;LogFilePrefix=results", "--results-directory", TESTRESULTSDIR}
+	coverage = coverage || minLineCoverage > 0
+	if coverage {
+		args = append(args, "--collect", "XPlat Code Coverage")
+	}
 
-	return m
+	c, err := m.withTestEnvironment(ctx, m.Base.WithDirectory(WORKDIR, m.Container.Directory(WORKDIR)))
+	if err != nil {
+		return nil, err
+	}
+	c = c.
+		WithExec([]string{"mkdir", "-p", TESTRESULTSDIR}).
+		WithExec(inSh(`"$@" 2>&1`, args...), dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	code, err := c.ExitCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.Container = c
+
+	results := c.Directory(TESTRESULTSDIR)
+	r, err := newTestResults(ctx, results, code, out)
+	if err != nil {
+		return nil, err
+	}
+	m.TestResults = r
+	if coverage {
+		r.MinLineCoverage = minLineCoverage
+		if err := m.mergeCoverage(ctx, results, r); err != nil {
+			return nil, err
+		}
+	}
+	if failOnError {
+		if _, err := r.Assert(ctx); err != nil {
+			return r, err
+		}
+	}
+	if err := r.checkCoverage(); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 // Publish with runtime
+//
+// Modes other than framework-dependent publish for the engine platform and
+// are used by BuildContainer for all platforms.
 func (m *Dotnet) Publish(
 	ctx context.Context,
-) *Dotnet {
-	m.Container = m.Base.
+	// How to publish: framework-dependent, self-contained, single-file or native-aot
+	// +default="framework-dependent"
+	mode string,
+	// Trim unused code, always done for native-aot
+	// +default=false
+	trim bool,
+	// Trim mode: full or partial
+	// +optional
+	trimMode string,
+) (*Dotnet, error) {
+	switch mode {
+	case "framework-dependent":
+		if trim || trimMode != "" {
+			return nil, fmt.Errorf("trimming requires a self-contained mode")
+		}
+	case "self-contained", "single-file", "native-aot":
+	default:
+		return nil, fmt.Errorf("invalid mode %q: must be framework-dependent, self-contained, single-file or native-aot", mode)
+	}
+	if trimMode != "" && trimMode != "full" && trimMode != "partial" {
+		return nil, fmt.Errorf("invalid trim mode %q: must be full or partial", trimMode)
+	}
+	if len(m.EntrypointProjects) == 0 {
+		return nil, fmt.Errorf("no entrypoint project to publish")
+	}
+	m.PublishMode, m.Trim, m.TrimMode = mode, trim, trimMode
+
+	runtime := ""
+	if mode != "framework-dependent" {
+		platform, err := dag.DefaultPlatform(ctx)
+		if err != nil {
+			return nil, err
+		}
+		runtime, err = runtimeIdentifier(platform)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Each project publishes from the same build, merged afterwards
+	c := m.Base.
 		WithDirectory(WORKDIR, m.Container.Directory(WORKDIR)).
-		WithWorkdir(m.EntrypointProject).
-		WithExec(inSh("dotnet publish --configuration %s --no-build --output ../app /p:UseAppHost=false", m.Configuration))
+		WithoutDirectory(WORKDIR + "app")
+	for _, project := range m.EntrypointProjects {
+		output := appDir(project)
+		if runtime == "" {
+			c = c.WithDirectory(output, m.Base.
+				WithDirectory(WORKDIR, m.Container.Directory(WORKDIR)).
+				WithWorkdir(project).
+				WithExec([]string{"dotnet", "publish", "--configuration", m.Configuration, "--no-build", "--output", output, "/p:UseAppHost=false"}).
+				Directory(output))
+		} else {
+			c = c.WithDirectory(output, m.publish(project, runtime).Directory(output))
+		}
+	}
+	m.Container = c
 
-	return m
+	return m, nil
+}
+
+// Output directory of a published project
+func appDir(
+	project string,
+) string {
+	return WORKDIR + "app/" + project
+}
+
+// Publish a project for a runtime with the current publish mode
+func (m *Dotnet) publish(
+	project string,
+	runtime string,
+) *dagger.Container {
+	c := m.Base
+	if m.PublishMode == "native-aot" {
+		c = c.WithExec([]string{"apk", "add", "--no-cache", "build-base", "clang", "zlib-dev"})
+	}
+	return c.
+		WithDirectory(WORKDIR, m.Container.Directory(WORKDIR)).
+		WithoutDirectory(appDir(project)).
+		WithWorkdir(project).
+		WithExec(m.publishArgs(project, runtime))
+}
+
+// Arguments of dotnet publish for the publish mode and trimming
+func (m *Dotnet) publishArgs(
+	project string,
+	runtime string,
+) []string {
+	args := []string{"dotnet", "publish", "--configuration", m.Configuration, "--runtime", runtime, "--output", appDir(project)}
+	switch m.PublishMode {
+	case "framework-dependent":
+		args = append(args, "--self-contained", "false", "/p:UseAppHost=false")
+	case "self-contained":
+		args = append(args, "--self-contained", "true")
+	case "single-file":
+		args = append(args, "--self-contained", "true", "/p:PublishSingleFile=true")
+	case "native-aot":
+		args = append(args, "/p:PublishAot=true")
+	}
+	if m.Trim {
+		args = append(args, "/p:PublishTrimmed=true")
+	}
+	if m.TrimMode != "" {
+		args = append(args, "/p:TrimMode="+m.TrimMode)
+	}
+	return args
+}
+
+// Runtime images, one per platform
+type DotnetImage struct {
+	// Entrypoint project the image runs
+	Project string
+	// Image for each platform
+	Variants []*dagger.Container
+	// CycloneDX SBOM of the app's NuGet dependencies
+	Sbom *dagger.File
 }
 
 // Build container with runtime
+//
+// Images are labeled with org.opencontainers.image.* from the arguments,
+// falling back to the entrypoint project's csproj.
 func (m *Dotnet) BuildContainer(
 	ctx context.Context,
+	// Creation time for the image labels and SBOM in RFC 3339, e.g. the commit timestamp
+	// Omitted if not given, keeping the image reproducible
+	// +optional
+	created string,
+	// Platforms to build for, publishing the app with the matching runtime
+	// Defaults to the engine platform, using the already published app
+	// +optional
+	platforms []dagger.Platform,
+	// Entrypoint project to build
+	// Required if there are multiple entrypoint projects
+	// +optional
+	project string,
+	// Commit the image is built from
+	// +optional
+	revision string,
+	// URL of the source repository
+	// Defaults to RepositoryUrl of the csproj
+	// +optional
+	source string,
 	// Tag to use as image name
 	// +default=""
 	tag string,
-) *dagger.Container {
-	c := dag.Container().
-		WithDirectory(WORKDIR, m.Container.Directory(WORKDIR)).
-		WithWorkdir(WORKDIR).
-		WithNewFile("Dockerfile", dotnet__Dockerfile).
-		Directory("/src").
-		DockerBuild(dagger.DirectoryDockerBuildOpts{
-			BuildArgs: []dagger.BuildArg{
-				{Name: "PROJECT_NAME", Value: m.EntrypointProject},
-			}},
-		)
+	// Version of the app
+	// Defaults to Version of the csproj
+	// +optional
+	version string,
+) (*DotnetImage, error) {
+	project, err := m.entrypointProject(project)
+	if err != nil {
+		return nil, err
+	}
+	return m.buildImage(ctx, created, platforms, project, revision, source, tag, version)
+}
+
+// Build containers with runtime for all entrypoint projects in parallel
+func (m *Dotnet) BuildContainers(
+	ctx context.Context,
+	// Creation time for the image labels and SBOM in RFC 3339, e.g. the commit timestamp
+	// Omitted if not given, keeping the image reproducible
+	// +optional
+	created string,
+	// Platforms to build for, publishing the apps with the matching runtime
+	// Defaults to the engine platform, using the already published apps
+	// +optional
+	platforms []dagger.Platform,
+	// Commit the images are built from
+	// +optional
+	revision string,
+	// URL of the source repository
+	// Defaults to RepositoryUrl of each csproj
+	// +optional
+	source string,
+	// Version of the apps
+	// Defaults to Version of each csproj
+	// +optional
+	version string,
+) ([]*DotnetImage, error) {
+	if len(m.EntrypointProjects) == 0 {
+		return nil, fmt.Errorf("no entrypoint project to build")
+	}
+
+	images := make([]*DotnetImage, len(m.EntrypointProjects))
+	eg, gctx := errgroup.WithContext(ctx)
+	for i, project := range m.EntrypointProjects {
+		eg.Go(func() error {
+			image, err := m.buildImage(gctx, created, platforms, project, revision, source, "", version)
+			if err != nil {
+				return fmt.Errorf("%s: %w", project, err)
+			}
+			for _, variant := range image.Variants {
+				if _, err := variant.Sync(gctx); err != nil {
+					return fmt.Errorf("%s: %w", project, err)
+				}
+			}
+			images[i] = image
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
 
-	if tag != "" {
-		c = c.WithAnnotation("io.containerd.image.name", tag)
+// Named entrypoint project, or the only one if no name is given
+func (m *Dotnet) entrypointProject(
+	project string,
+) (string, error) {
+	if project == "" {
+		if len(m.EntrypointProjects) != 1 {
+			return "", fmt.Errorf("project is required with %d entrypoint projects", len(m.EntrypointProjects))
+		}
+		return m.EntrypointProjects[0], nil
+	}
+	if !slices.Contains(m.EntrypointProjects, project) {
+		return "", fmt.Errorf("%s is not an entrypoint project, must be one of %s", project, strings.Join(m.EntrypointProjects, ", "))
 	}
+	return project, nil
+}
 
-	return c
+func (m *Dotnet) buildImage(
+	ctx context.Context,
+	created string,
+	platforms []dagger.Platform,
+	project string,
+	revision string,
+	source string,
+	tag string,
+	version string,
+) (*DotnetImage, error) {
+	if created != "" {
+		if _, err := time.Parse(time.RFC3339, created); err != nil {
+			return nil, fmt.Errorf("invalid created %q: must be RFC 3339, e.g. 2024-01-02T15:04:05Z", created)
+		}
+	}
+	metadata, err := m.project(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	if source == "" {
+		source = metadata.RepositoryUrl
+	}
+	if version == "" {
+		version = metadata.Version
+	}
+	labels := [][2]string{
+		{"org.opencontainers.image.created", created},
+		{"org.opencontainers.image.description", metadata.Description},
+		{"org.opencontainers.image.licenses", metadata.PackageLicenseExpression},
+		{"org.opencontainers.image.revision", revision},
+		{"org.opencontainers.image.source", source},
+		{"org.opencontainers.image.title", metadata.title(project)},
+		{"org.opencontainers.image.vendor", metadata.Company},
+		{"org.opencontainers.image.version", version},
+	}
+
+	images, err := channelImages(metadata.channel(m.Channel))
+	if err != nil {
+		return nil, err
+	}
+	sbom, err := m.sbom(ctx, created, project, metadata.title(project), version)
+	if err != nil {
+		return nil, err
+	}
+	image := &DotnetImage{Project: project, Sbom: sbom}
+	if len(platforms) == 0 {
+		image.Variants = []*dagger.Container{m.buildContainer(m.Container.Directory(WORKDIR), images, "", project, tag)}
+	}
+	for _, platform := range platforms {
+		runtime, err := runtimeIdentifier(platform)
+		if err != nil {
+			return nil, err
+		}
+		if m.PublishMode == "native-aot" {
+			// Native AOT compiles with the host toolchain, which cannot target another architecture
+			host, err := dag.DefaultPlatform(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if hostRuntime, _ := runtimeIdentifier(host); hostRuntime != runtime {
+				return nil, fmt.Errorf("native-aot cannot cross-compile for %s on a %s engine", platform, host)
+			}
+		}
+		image.Variants = append(image.Variants, m.buildContainer(m.publish(project, runtime).Directory(WORKDIR), images, platform, project, tag))
+	}
+
+	for i, c := range image.Variants {
+		for _, label := range labels {
+			if label[1] != "" {
+				c = c.WithLabel(label[0], label[1])
+			}
+		}
+		image.Variants[i] = c
+	}
+
+	return image, nil
+}
+
+// Metadata of a csproj, the first value set in any PropertyGroup
+type csproj struct {
+	AssemblyName             string
+	Company                  string
+	Description              string
+	PackageLicenseExpression string
+	Product                  string
+	RepositoryUrl            string
+	TargetFramework          string
+	TargetFrameworks         string
+	Title                    string
+	Version                  string
+}
+
+// Target frameworks, e.g. net8.0
+func (p *csproj) frameworks() []string {
+	if p.TargetFramework != "" {
+		return []string{p.TargetFramework}
+	}
+	frameworks := []string{}
+	for _, framework := range strings.Split(p.TargetFrameworks, ";") {
+		if framework = strings.TrimSpace(framework); framework != "" {
+			frameworks = append(frameworks, framework)
+		}
+	}
+	return frameworks
+}
+
+// Channel of the runtime, the newest target framework or the SDK channel
+func (p *csproj) channel(
+	sdk string,
+) string {
+	return cmp.Or(newestFrameworkChannel(p.frameworks()), sdk)
+}
+
+func (p *csproj) title(
+	fallback string,
+) string {
+	return cmp.Or(p.Title, p.Product, p.AssemblyName, fallback)
+}
+
+// Metadata of an entrypoint project
+func (m *Dotnet) project(
+	ctx context.Context,
+	project string,
+) (*csproj, error) {
+	return readCsproj(ctx, m.Container.Directory(WORKDIR), path.Join(project, project+".csproj"))
+}
+
+func readCsproj(
+	ctx context.Context,
+	dir *dagger.Directory,
+	file string,
+) (*csproj, error) {
+	contents, err := dir.File(file).Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := struct {
+		PropertyGroups []csproj `xml:"PropertyGroup"`
+	}{}
+	if err := xml.Unmarshal([]byte(contents), &groups); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	metadata := &csproj{}
+	for _, g := range groups.PropertyGroups {
+		metadata.AssemblyName = cmp.Or(metadata.AssemblyName, strings.TrimSpace(g.AssemblyName))
+		metadata.Company = cmp.Or(metadata.Company, strings.TrimSpace(g.Company))
+		metadata.Description = cmp.Or(metadata.Description, strings.TrimSpace(g.Description))
+		metadata.PackageLicenseExpression = cmp.Or(metadata.PackageLicenseExpression, strings.TrimSpace(g.PackageLicenseExpression))
+		metadata.Product = cmp.Or(metadata.Product, strings.TrimSpace(g.Product))
+		metadata.RepositoryUrl = cmp.Or(metadata.RepositoryUrl, strings.TrimSpace(g.RepositoryUrl))
+		metadata.TargetFramework = cmp.Or(metadata.TargetFramework, strings.TrimSpace(g.TargetFramework))
+		metadata.TargetFrameworks = cmp.Or(metadata.TargetFrameworks, strings.TrimSpace(g.TargetFrameworks))
+		metadata.Title = cmp.Or(metadata.Title, strings.TrimSpace(g.Title))
+		metadata.Version = cmp.Or(metadata.Version, strings.TrimSpace(g.Version))
+	}
+	return metadata, nil
+}
+
+// Runtime identifier of the Alpine base image for a platform
+func runtimeIdentifier(
+	platform dagger.Platform,
+) (string, error) {
+	p, err := parsePlatform(string(platform))
+	if err != nil {
+		return "", err
+	}
+	if p.os == "linux" {
+		switch p.architecture {
+		case "amd64":
+			return "linux-musl-x64", nil
+		case "arm64":
+			return "linux-musl-arm64", nil
+		case "arm":
+			if p.variant == "" || p.variant == "v7" {
+				return "linux-musl-arm", nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unsupported platform %s: must be linux/amd64, linux/arm64 or linux/arm/v7", platform)
+}
+
+// OCI index containing all variants, e.g. for docker load or skopeo
+func (m *DotnetImage) Tarball(
+	ctx context.Context,
+) *dagger.File {
+	return dag.Container().AsTarball(dagger.ContainerAsTarballOpts{PlatformVariants: m.Variants})
+}
+
+// Push all variants as a manifest list, returns the reference with digest
+func (m *DotnetImage) Publish(
+	ctx context.Context,
+	// Address to push to, e.g. ghcr.io/owner/app:1.0.0
+	address string,
+) (string, error) {
+	return dag.Container().Publish(ctx, address, dagger.ContainerPublishOpts{PlatformVariants: m.Variants})
+}
+
+// Push runtime images to a registry, logging in with the cred matching its host
+//
+// All tags point to the same manifest list, which is optionally signed with cosign.
+func (m *Dotnet) PublishImage(
+	ctx context.Context,
+	// Creation time for the image labels and SBOM in RFC 3339, e.g. the commit timestamp
+	// Omitted if not given, keeping the image reproducible
+	// +optional
+	created string,
+	// Use plain HTTP for the registry
+	// +default=false
+	plainHttp bool,
+	// Platforms to build for
+	// Defaults to the engine platform, using the already published app
+	// +optional
+	platforms []dagger.Platform,
+	// Entrypoint project to push
+	// Required if there are multiple entrypoint projects
+	// +optional
+	project string,
+	// Repository to push to, e.g. ghcr.io/owner/app
+	repository string,
+	// Commit SHA to tag
+	// +optional
+	sha string,
+	// Cosign private key to sign the pushed digest with
+	// +optional
+	signingKey *dagger.Secret,
+	// Password of the cosign private key
+	// +optional
+	signingPassword *dagger.Secret,
+	// URL of the source repository, for the image labels
+	// +optional
+	source string,
+	// Additional tags
+	// +optional
+	tags []string,
+	// Upload the signature to the public Rekor transparency log, exposing the image name
+	// Keep disabled for private images
+	// +default=false
+	tlogUpload bool,
+	// SemVer to tag, also tags major and major.minor unless it is a prerelease
+	// +optional
+	version string,
+) ([]string, error) {
+	image, err := m.BuildContainer(ctx, created, platforms, project, sha, source, "", version)
+	if err != nil {
+		return nil, err
+	}
+	return publishImage(ctx, m.Publisher, m.Module.Creds, image, plainHttp, repository, sha, signingKey, signingPassword, tags, tlogUpload, version)
+}
+
+func publishContainer() *dagger.Container {
+	return dag.Container().
+		From("docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b").
+		WithExec([]string{"apk", "add", "--no-cache", "cosign", "skopeo"}).
+		// Shared by skopeo and cosign
+		WithEnvVariable("REGISTRY_AUTH_FILE", "/root/.docker/config.json")
+}
+
+func publishImage(
+	ctx context.Context,
+	container *dagger.Container,
+	creds []*Cred,
+	image *DotnetImage,
+	plainHttp bool,
+	repository string,
+	sha string,
+	signingKey *dagger.Secret,
+	signingPassword *dagger.Secret,
+	tags []string,
+	tlogUpload bool,
+	version string,
+) ([]string, error) {
+	ref, err := parseImageRef(repository)
+	if err != nil {
+		return nil, err
+	}
+	if ref.Tag != "" || ref.Digest != "" {
+		return nil, fmt.Errorf("repository %s must not have a tag or digest", repository)
+	}
+	tags, err = imageTags(sha, tags, version)
+	if err != nil {
+		return nil, err
+	}
+	cred, err := getCredByUrl(creds, ref.Registry)
+	if err != nil {
+		return nil, err
+	}
+
+	c := container.
+		WithEnvVariable("CACHE_BUST", time.Now().String()).
+		WithFile("/image.tar", image.Tarball(ctx))
+	if cred != nil {
+		login, err := newCommand("skopeo", "login").
+			withFlag("tls-verify", strconv.FormatBool(!plainHttp)).
+			withFlag("username", cred.UserId).
+			with("--password-stdin", ref.Registry).
+			build()
+		if err != nil {
+			return nil, err
+		}
+		c = c.
+			WithSecretVariable("__PASSWORD", cred.UserSecret).
+			WithExec(inSh(`echo "$__PASSWORD" | "$@"`, login...)).
+			WithoutSecretVariable("__PASSWORD")
+	}
+	for _, tag := range tags {
+		c = c.WithExec([]string{"skopeo", "copy", "--all", "--dest-tls-verify=" + strconv.FormatBool(!plainHttp), "--digestfile", "/digest", "oci-archive:/image.tar", "docker://" + ref.with(tag, "")})
+	}
+	digest, err := c.File("/digest").Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	digest = strings.TrimSpace(digest)
+
+	if signingKey != nil {
+		sign := newCommand("cosign", "sign", "--yes", "--key", "env://COSIGN_KEY").
+			withFlag("tlog-upload", strconv.FormatBool(tlogUpload)).
+			withBool("allow-http-registry", plainHttp)
+		if signingPassword != nil {
+			c = c.WithSecretVariable("COSIGN_PASSWORD", signingPassword)
+		} else {
+			c = c.WithEnvVariable("COSIGN_PASSWORD", "")
+		}
+		args, err := sign.with(ref.with("", digest)).build()
+		if err != nil {
+			return nil, err
+		}
+		c = c.
+			WithSecretVariable("COSIGN_KEY", signingKey).
+			WithExec(args)
+		if _, err := c.Sync(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	refs := make([]string, len(tags))
+	for i, tag := range tags {
+		refs[i] = ref.with(tag, digest)
+	}
+	return refs, nil
+}
+
+// Tags for a version, e.g. 1.2.3, 1.2 and 1, followed by the SHA and additional tags
+func imageTags(
+	sha string,
+	tags []string,
+	version string,
+) ([]string, error) {
+	all := []string{}
+	if version != "" {
+		v, err := semver.NewVersion(version)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q: %w", version, err)
+		}
+		all = append(all, v.String())
+		if v.Prerelease() == "" {
+			all = append(all, fmt.Sprintf("%d.%d", v.Major(), v.Minor()), fmt.Sprintf("%d", v.Major()))
+		}
+	}
+	if sha != "" {
+		all = append(all, sha)
+	}
+	all = append(all, tags...)
+
+	unique := []string{}
+	for _, tag := range all {
+		// Build metadata is not allowed in tags
+		tag = strings.ReplaceAll(tag, "+", "_")
+		if !imageTagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		if !slices.Contains(unique, tag) {
+			unique = append(unique, tag)
+		}
+	}
+	if len(unique) == 0 {
+		return nil, fmt.Errorf("no tags given: set version, sha or tags")
+	}
+	return unique, nil
 }
 
 // Set up NuGet config
@@ -162,8 +1100,7 @@ func (m *Dotnet) WithNugetGhcr(
 		return nil, fmt.Errorf("no creds found")
 	}
 
-	feed := fmt.Sprintf("https://nuget.pkg.github.com/%s/index.json", cred.Name)
-	return m.withNuget(ctx, feed, cred.Name, cred.UserId, cred.UserSecret)
+	return m.withNuget(ctx, githubNugetFeed(cred.Name), cred.Name, cred.UserId, cred.UserSecret)
 }
 
 func getCred(
@@ -194,12 +1131,26 @@ func (m *Dotnet) withNuget(
 	userId string,
 	userSecret *dagger.Secret,
 ) (*Dotnet, error) {
+	if err := errors.Join(
+		validateUrl("feed", feed),
+		validateIdentifier("source name", name),
+	); err != nil {
+		return nil, err
+	}
+
+	password, err := userSecret.Plaintext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(userId, ";") || strings.Contains(password, ";") {
+		return nil, fmt.Errorf("user id and secret of source %s must not contain ';'", name)
+	}
+	// Read by NuGet at exec time, so the secret never ends up in the config
+	credentials := dag.SetSecret("nuget-source-credentials-"+name, fmt.Sprintf("Username=%s;Password=%s", userId, password))
+
 	m.Base = m.Base.
-		WithSecretVariable("__PASSWORD", userSecret).
-		WithEnvVariable("__USERNAME", userId).
-		WithExec(inSh("dotnet nuget add source --username $__USERNAME --password $__PASSWORD --store-password-in-clear-text --name %s %s --configfile /root/nuget/nuget.config", name, feed)).
-		WithoutSecretVariable("__PASSWORD").
-		WithoutEnvVariable("__USERNAME")
+		WithExec([]string{"dotnet", "nuget", "add", "source", feed, "--name", name, "--configfile", NUGETCONFIG}).
+		WithSecretVariable("NuGetPackageSourceCredentials_"+name, credentials)
 
 	return m, nil
 }
@@ -3,10 +3,18 @@ package main
 import (
 	"context"
 	"dagger/mikael-elkiaer/internal/dagger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
 )
 
 const (
-	PACKAGE     = WORKDIR + "package.tgz"
 	TEMPLATEDIR = WORKDIR + "templated"
 	WORKDIR     = "/src/"
 )
@@ -19,7 +27,11 @@ type Helm struct {
 	//+private
 	Module *MikaelElkiaer
 	//+private
+	PackagePath string
+	//+private
 	TargetKubernetesVersion string
+	// Results of the latest install, one per profile
+	Installs []*HelmInstallResult
 }
 
 // Submodule for Helm
@@ -31,6 +43,9 @@ func (m *MikaelElkiaer) Helm(
 	// +default="1.29"
 	targetKubernetesVersion string,
 ) (*Helm, error) {
+	if err := validateKubernetesVersion(targetKubernetesVersion); err != nil {
+		return nil, err
+	}
 	c, err := m.createHelmContainer(ctx)
 	if err != nil {
 		return nil, err
@@ -53,7 +68,7 @@ func (m *Helm) Build(
 	ctx context.Context,
 ) (*Helm, error) {
 	m.Container = m.Base.WithDirectory(WORKDIR, m.workdir(), dagger.ContainerWithDirectoryOpts{Include: []string{"Chart.lock", "Chart.yaml"}}).
-		WithExec(inSh(`touch Chart.lock && yq --indent 0 '.dependencies | map(select(.repository | test("^https?://")) | ["helm", "repo", "add", .name, .repository] | join(" ")) | .[]' ./Chart.lock | sh --;`)).
+		WithExec(inSh(`touch Chart.lock && yq '.dependencies[] | select(.repository | test("^https?://")) | .name + " " + .repository' ./Chart.lock | while read -r name repository; do helm repo add "$name" "$repository"; done`)).
 		WithExec(inSh(`helm dependency build`)).
 		WithDirectory(WORKDIR, m.workdir(), dagger.ContainerWithDirectoryOpts{Exclude: []string{"charts"}})
 
@@ -74,7 +89,6 @@ func (m *Helm) Lint(
 func (m *Helm) Schema(
 	ctx context.Context,
 ) (*Helm, error) {
-	// TODO: Actually implement function to update the version
 	// @version policy=~0.13.0-0 resolved=0.13.1-2
 	m.Container = m.Base.WithExec(inSh(`go install github.com/dadav/helm-schema/cmd/helm-schema@7da61f883f9d1e7882ff5677ebde1100392ebed2`)).
 		WithDirectory(WORKDIR, m.workdir()).
@@ -87,7 +101,6 @@ func (m *Helm) Schema(
 func (m *Helm) Docs(
 	ctx context.Context,
 ) (*Helm, error) {
-	// TODO: Actually implement function to update the version
 	// @version policy=~v1.0.0 resolved=v1.14.2
 	m.Container = m.Base.WithExec(inSh(`go install github.com/norwoodj/helm-docs/cmd/helm-docs@37d3055fece566105cf8cff7c17b7b2355a01677`)).
 		WithDirectory(WORKDIR, m.workdir()).
@@ -139,40 +152,175 @@ func (m *Helm) Check(
 // Package Helm chart
 func (m *Helm) Package(
 	ctx context.Context,
+	// App version to stamp, overrides Chart.yaml
+	// +optional
+	appVersion string,
+	// Git repository to derive the prerelease from
+	// Defaults to the chart source
+	// +optional
+	git *dagger.Directory,
+	// Derive a SemVer prerelease from git, appended to the chart version
+	// "describe": <commits since tag>.g<sha>, "sha": g<sha>
+	// +optional
+	prerelease string,
+	// Chart version to stamp, overrides Chart.yaml
+	// +optional
+	version string,
 ) (*Helm, error) {
-	m.Container = m.Base.WithDirectory(WORKDIR, m.workdir()).
-		WithExec(inSh(`helm package .`)).
-		WithExec(inSh(`mv *.tgz %s`, PACKAGE))
+	c := m.Base.WithDirectory(WORKDIR, m.workdir())
 
+	if prerelease != "" {
+		if version == "" {
+			v, err := c.WithExec([]string{"yq", ".version", "Chart.yaml"}).Stdout(ctx)
+			if err != nil {
+				return nil, err
+			}
+			version = strings.TrimSpace(v)
+		}
+		if git == nil {
+			git = m.workdir()
+		}
+		suffix, err := gitPrerelease(ctx, c.WithMountedDirectory("/git", git), prerelease)
+		if err != nil {
+			return nil, err
+		}
+		version = appendPrerelease(version, suffix)
+	}
+
+	args := []string{"helm", "package", "."}
+	if version != "" {
+		args = append(args, "--version", version)
+	}
+	if appVersion != "" {
+		args = append(args, "--app-version", appVersion)
+	}
+	c = c.WithExec(args)
+
+	out, err := c.Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, path, ok := strings.Cut(out, "saved it to: ")
+	if !ok {
+		return nil, fmt.Errorf("unexpected output from helm package: %s", out)
+	}
+	path, _, _ = strings.Cut(path, "\n")
+
+	m.Container = c
+	m.PackagePath = path
 	return m, nil
 }
 
+// Packaged Helm chart, named after the stamped version
+func (m *Helm) PackageFile(
+	ctx context.Context,
+) (*dagger.File, error) {
+	if m.PackagePath == "" {
+		return nil, fmt.Errorf("chart has not been packaged")
+	}
+	return m.Container.File(m.PackagePath), nil
+}
+
 // Template Helm chart using source
 func (m *Helm) Template(
 	ctx context.Context,
 	// Additional arguments to pass to helm template
 	// +default=""
 	additionalArgs string,
+	// Values to set, e.g. image.tag=1.0.0
+	// +optional
+	set []string,
+	// Values files, applied in order
+	// +optional
+	valuesFiles []*dagger.File,
 ) (*Helm, error) {
-	m.Container = m.Base.WithDirectory(WORKDIR, m.workdir()).
-		WithExec(inSh(`helm template %s --output-dir=%s %s`, ".", TEMPLATEDIR, additionalArgs))
+	c, values, err := withValues(ctx, m.Base.WithDirectory(WORKDIR, m.workdir()), valuesFiles, set)
+	if err != nil {
+		return nil, err
+	}
+	args, err := newCommand("helm", "template", ".").
+		withFlag("output-dir", TEMPLATEDIR).
+		with(values...).
+		withShellWords(additionalArgs).
+		build()
+	if err != nil {
+		return nil, err
+	}
+	m.Container = c.WithExec(args)
 
 	return m, nil
 }
 
+// Reference to a pushed Helm chart
+type HelmPushResult struct {
+	// Name of the chart
+	Chart string
+	// Version of the chart
+	Version string
+	// Manifest digest of the pushed chart
+	Digest string
+	// Full reference, including digest
+	Reference string
+}
+
 // Push Helm package to registry
 func (m *Helm) Push(
 	ctx context.Context,
-	// Registry URI to push the Helm package
+	// Use plain HTTP instead of HTTPS
+	// +default=false
+	plainHttp bool,
+	// Registry URI to push the Helm package, e.g. oci://ghcr.io/owner/charts
 	registry string,
-) (*Helm, error) {
-	m.Container = m.Base.WithDirectory(WORKDIR, m.workdir()).
-		WithExec(inSh(`helm push %s`, PACKAGE, registry))
+) (*HelmPushResult, error) {
+	if m.PackagePath == "" {
+		return nil, fmt.Errorf("chart has not been packaged")
+	}
+	host, err := ociHost(registry)
+	if err != nil {
+		return nil, err
+	}
+	cred, err := getCredByUrl(m.Module.Creds, host)
+	if err != nil {
+		return nil, err
+	}
 
-	return m, nil
+	c := m.Base.WithDirectory(WORKDIR, m.workdir())
+	if cred != nil {
+		login, err := newCommand("helm", "registry", "login").
+			withBool("plain-http", plainHttp).
+			withFlag("username", cred.UserId).
+			with("--password-stdin", host).
+			build()
+		if err != nil {
+			return nil, err
+		}
+		c = c.
+			WithSecretVariable("__PASSWORD", cred.UserSecret).
+			WithExec(inSh(`echo "$__PASSWORD" | "$@"`, login...)).
+			WithoutSecretVariable("__PASSWORD")
+	}
+	push, err := newCommand("helm", "push").
+		withBool("plain-http", plainHttp).
+		with(m.PackagePath, registry).
+		build()
+	if err != nil {
+		return nil, err
+	}
+	c = c.WithExec(inSh(`"$@" 2>&1`, push...))
+
+	out, err := c.Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.Container = c
+
+	return parseHelmPush(out)
 }
 
 // Install Helm package to a cluster
+//
+// Each profile is uninstalled again and its result kept in Installs. Failing
+// profiles are left installed for the terminal when debugging.
 func (m *Helm) Install(
 	ctx context.Context,
 	// Additional arguments to pass to helm upgrade
@@ -188,19 +336,40 @@ func (m *Helm) Install(
 	// Required if kubernetesService is provided
 	// +optional
 	kubeconfig *dagger.File,
+	// Install once per values file in parallel, each in its own namespace
+	// +default=false
+	matrix bool,
 	// Name of the Helm release
 	// +default="test"
 	name string,
 	// Namespace of the Helm release
+	// Suffixed with the profile index in matrix mode
 	// +default="testing"
 	namespace string,
 	// Containers to load into the cluster
 	// +optional
 	preloadContainers []*dagger.Container,
+	// Values to set, e.g. image.tag=1.0.0
+	// +optional
+	set []string,
 	// Timeout for Helm operations
 	// +default="300s"
 	timeout string,
+	// Values files, applied in order, or one profile each in matrix mode
+	// +optional
+	valuesFiles []*dagger.File,
 ) (*Helm, error) {
+	if err := errors.Join(
+		validateDnsLabel("release name", name),
+		validateDnsLabel("namespace", namespace),
+		validateDuration("timeout", timeout),
+	); err != nil {
+		return nil, err
+	}
+	if _, err := shellWords(additionalArgs); err != nil {
+		return nil, err
+	}
+
 	c := m.Base.WithDirectory(WORKDIR, m.workdir())
 
 	if kubernetesService == nil {
@@ -222,26 +391,125 @@ func (m *Helm) Install(
 			WithExec(inSh(`sed -E 's,(server: https://)(.+)(:.+)$,\1kubernetes\3,' -i /root/.kube/config`))
 	}
 
-	c = c.WithExec(inSh(`kubectl create namespace %s --dry-run=client --output=json | kubectl apply -f -`, namespace))
-	c = withDockerPullSecrets(c, m.Module.Creds, namespace)
-	c, err := c.WithExec(inSh(`helm upgrade %s %s --debug --install --namespace=%s --timeout=%s --wait %s`, name, ".", namespace, timeout, additionalArgs)).
-		Sync(ctx)
-
+	profiles, err := helmProfiles(ctx, valuesFiles, matrix)
 	if err != nil {
-		if debugTerminal {
-			c = c.Terminal()
-		} else {
-			return nil, err
+		return nil, err
+	}
+
+	namespaces := make([]string, len(profiles))
+	for i := range profiles {
+		namespaces[i] = namespace
+		if matrix {
+			namespaces[i] = fmt.Sprintf("%s-%d", namespace, i)
+			if err := validateDnsLabel("namespace", namespaces[i]); err != nil {
+				return nil, err
+			}
 		}
-	} else {
-		c = c.WithExec(inSh(`helm uninstall %s --debug --namespace %s --wait`, name, namespace)).
-			WithExec(inSh(`kubectl delete namespace %s`, namespace))
+	}
+
+	containers := make([]*dagger.Container, len(profiles))
+	results := make([]*HelmInstallResult, len(profiles))
+	eg, gctx := errgroup.WithContext(ctx)
+	for i, profile := range profiles {
+		ns := namespaces[i]
+		eg.Go(func() error {
+			result := &HelmInstallResult{Profile: profile.name, Namespace: ns}
+			results[i] = result
+
+			pc, values, err := withValues(gctx, c, profile.valuesFiles, set)
+			if err != nil {
+				return err
+			}
+			upgrade, err := newCommand("helm", "upgrade", name, ".", "--debug", "--install", "--wait").
+				withFlag("namespace", ns).
+				withFlag("timeout", timeout).
+				with(values...).
+				withShellWords(additionalArgs).
+				build()
+			if err != nil {
+				return err
+			}
+			pc = pc.WithExec(inSh(`kubectl create namespace "$1" --dry-run=client --output=json | kubectl apply -f -`, ns))
+			pc = withDockerPullSecrets(pc, m.Module.Creds, ns)
+			installed, err := pc.WithExec(upgrade).
+				Sync(gctx)
+			if err != nil {
+				result.Error = err.Error()
+				containers[i] = pc
+				if debugTerminal {
+					// Left installed to be inspected in the terminal
+					return nil
+				}
+				installed = pc
+			}
+
+			// Each profile is torn down here, so none is left behind on the cluster
+			uninstalled, err := installed.
+				WithExec([]string{"helm", "uninstall", name, "--debug", "--ignore-not-found", "--namespace", ns, "--wait"}).
+				WithExec([]string{"kubectl", "delete", "namespace", ns, "--ignore-not-found"}).
+				Sync(gctx)
+			if err != nil {
+				if result.Error != "" {
+					result.Error += "; "
+				}
+				result.Error += "uninstall: " + err.Error()
+				return nil
+			}
+			if containers[i] == nil {
+				containers[i] = uninstalled
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	m.Installs = results
+
+	c = containers[0]
+	failed := []string{}
+	for i, r := range results {
+		if r.Error == "" {
+			continue
+		}
+		if debugTerminal && len(failed) == 0 {
+			c = containers[i].Terminal()
+		}
+		failed = append(failed, r.describe())
+	}
+	if len(failed) > 0 && !debugTerminal {
+		lines := make([]string, len(results))
+		for i, r := range results {
+			lines[i] = r.describe()
+		}
+		return nil, fmt.Errorf("%d of %d profile(s) failed:\n%s", len(failed), len(results), strings.Join(lines, "\n"))
 	}
 
 	m.Container = c
 	return m, nil
 }
 
+// Outcome of installing one profile
+type HelmInstallResult struct {
+	// Name of the values file in matrix mode, empty otherwise
+	Profile string
+	// Namespace the profile was installed to
+	Namespace string
+	// Error of the install or uninstall, empty if both succeeded
+	Error string
+}
+
+func (r *HelmInstallResult) describe() string {
+	profile := ""
+	if r.Profile != "" {
+		profile = fmt.Sprintf(" (%s)", r.Profile)
+	}
+	if r.Error == "" {
+		return fmt.Sprintf("%s%s: ok", r.Namespace, profile)
+	}
+	return fmt.Sprintf("%s%s: %s", r.Namespace, profile, r.Error)
+}
+
 // Uninstall Helm package in a cluster
 func (m *Helm) Uninstall(
 	ctx context.Context,
@@ -265,12 +533,19 @@ func (m *Helm) Uninstall(
 	// +default="testing"
 	namespace string,
 ) (*Helm, error) {
+	if err := errors.Join(
+		validateDnsLabel("release name", name),
+		validateDnsLabel("namespace", namespace),
+	); err != nil {
+		return nil, err
+	}
+
 	c := m.Base.WithDirectory(WORKDIR, m.workdir())
 	c = c.WithServiceBinding("kubernetes", kubernetesService).
 		WithFile("/root/.kube/config", kubeconfig).
-		WithExec(inSh(`kubectl config set-cluster minikube --server=https://kubernetes:%d`, kubernetesPort)).
-		WithExec(inSh(`helm uninstall %s --debug --namespace %s --wait || true`, name, namespace)).
-		WithExec(inSh(`kubectl delete namespace %s || true`, namespace))
+		WithExec([]string{"kubectl", "config", "set-cluster", "minikube", fmt.Sprintf("--server=https://kubernetes:%d", kubernetesPort)}).
+		WithExec([]string{"helm", "uninstall", name, "--debug", "--namespace", namespace, "--wait"}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny}).
+		WithExec([]string{"kubectl", "delete", "namespace", namespace}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
 
 	m.Container = c
 	return m, nil
@@ -280,12 +555,9 @@ func (m *Helm) Uninstall(
 func (m *Helm) Validate(
 	ctx context.Context,
 ) (*Helm, error) {
-	m.Container = m.Base.
-		// TODO: Actually implement function to update the version
-		// @version policy=~0.4.0 resolved=0.4.0
-		WithExec(inSh(`go install sigs.k8s.io/kubectl-validate@fac15fd6e47976df8585fe18a73246d78642eab9`)).
+	m.Container = withKubectlValidate(m.Base).
 		WithDirectory(WORKDIR, m.workdir()).
-		WithExec(inSh(`/root/go/bin/kubectl-validate %s --version %s`, TEMPLATEDIR, m.TargetKubernetesVersion))
+		WithExec([]string{"/root/go/bin/kubectl-validate", TEMPLATEDIR, "--version", m.TargetKubernetesVersion})
 
 	return m, nil
 }
@@ -294,34 +566,347 @@ func (m *Helm) Validate(
 func (m *Helm) Pluto(
 	ctx context.Context,
 ) (*Helm, error) {
-	m.Container = m.Base.
-		WithExec(inSh(`wget https://github.com/FairwindsOps/pluto/releases/download/v5.19.4/pluto_5.19.4_linux_amd64.tar.gz -O pluto.tgz && tar -zxvf pluto.tgz pluto && mv pluto /usr/bin/pluto && rm pluto.tgz`)).
+	m.Container = withPluto(m.Base).
 		WithDirectory(WORKDIR, m.workdir()).
-		WithExec(inSh(`pluto detect-files --target-versions k8s=v%s --v 7 --directory %s`, m.TargetKubernetesVersion, TEMPLATEDIR))
+		WithExec([]string{"pluto", "detect-files", "--target-versions", "k8s=v" + m.TargetKubernetesVersion, "--v", "7", "--directory", TEMPLATEDIR})
 
 	return m, nil
 }
 
-// Run all checks
+// Run all checks on templated output, collecting findings from every tool
 func (m *Helm) CheckTemplated(
 	ctx context.Context,
-) (*Helm, error) {
-	m, err := m.Template(ctx, "")
+	// Check once per values file in parallel
+	// +default=false
+	matrix bool,
+	// Values to set, e.g. image.tag=1.0.0
+	// +optional
+	set []string,
+	// Values files, applied in order, or one profile each in matrix mode
+	// +optional
+	valuesFiles []*dagger.File,
+) (*Report, error) {
+	profiles, err := helmProfiles(ctx, valuesFiles, matrix)
 	if err != nil {
 		return nil, err
 	}
 
-	m, err = m.Validate(ctx)
+	findings := make([][]*Finding, len(profiles))
+	eg, gctx := errgroup.WithContext(ctx)
+	for i, profile := range profiles {
+		eg.Go(func() error {
+			f, err := m.checkTemplated(gctx, profile, set)
+			findings[i] = f
+			return err
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	report := &Report{}
+	for _, f := range findings {
+		report.add(f...)
+	}
+	return report, nil
+}
+
+func (m *Helm) checkTemplated(
+	ctx context.Context,
+	profile *helmProfile,
+	set []string,
+) ([]*Finding, error) {
+	findings := []*Finding{}
+
+	c, values, err := withValues(ctx, m.Base.WithDirectory(WORKDIR, m.workdir()), profile.valuesFiles, set)
+	if err != nil {
+		return nil, err
+	}
+	args, err := newCommand("helm", "template", ".").
+		withFlag("output-dir", TEMPLATEDIR).
+		with(values...).
+		build()
+	if err != nil {
+		return nil, err
+	}
+	templated := c.
+		WithExec([]string{"mkdir", "-p", TEMPLATEDIR}).
+		WithExec(args, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+	f, err := templateFindings(ctx, templated)
 	if err != nil {
 		return nil, err
 	}
+	findings = append(findings, f...)
+
+	eg, gctx := errgroup.WithContext(ctx)
+	var validateFindings, plutoFindings []*Finding
+	eg.Go(func() error {
+		out, err := withKubectlValidate(m.Base).
+			WithDirectory(WORKDIR, templated.Directory(WORKDIR)).
+			WithExec([]string{"/root/go/bin/kubectl-validate", TEMPLATEDIR, "--version", m.TargetKubernetesVersion, "--output", "json"}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny}).
+			Stdout(gctx)
+		if err != nil {
+			return err
+		}
+		validateFindings, err = parseKubectlValidate(out)
+		return err
+	})
+	eg.Go(func() error {
+		out, err := withPluto(m.Base).
+			WithDirectory(WORKDIR, templated.Directory(WORKDIR)).
+			WithExec([]string{"pluto", "detect-files", "--target-versions", "k8s=v" + m.TargetKubernetesVersion, "--output", "json", "--directory", TEMPLATEDIR}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny}).
+			Stdout(gctx)
+		if err != nil {
+			return err
+		}
+		plutoFindings, err = parsePluto(out)
+		return err
+	})
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	findings = append(findings, validateFindings...)
+	findings = append(findings, plutoFindings...)
+
+	for _, f := range findings {
+		f.Profile = profile.name
+	}
+	return findings, nil
+}
+
+// Set of values files to template or install with
+type helmProfile struct {
+	// Name of the values file in matrix mode, empty otherwise
+	name        string
+	valuesFiles []*dagger.File
+}
+
+func helmProfiles(
+	ctx context.Context,
+	valuesFiles []*dagger.File,
+	matrix bool,
+) ([]*helmProfile, error) {
+	if !matrix {
+		return []*helmProfile{{valuesFiles: valuesFiles}}, nil
+	}
+	if len(valuesFiles) == 0 {
+		return nil, fmt.Errorf("matrix mode requires at least one values file")
+	}
+
+	profiles := []*helmProfile{}
+	for _, f := range valuesFiles {
+		name, err := f.Name(ctx)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, &helmProfile{name: name, valuesFiles: []*dagger.File{f}})
+	}
+	return profiles, nil
+}
 
-	m, err = m.Pluto(ctx)
+// Mount values files and build the matching helm arguments
+func withValues(
+	ctx context.Context,
+	container *dagger.Container,
+	valuesFiles []*dagger.File,
+	set []string,
+) (*dagger.Container, []string, error) {
+	c := container
+	args := []string{}
+	for i, f := range valuesFiles {
+		name, err := f.Name(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		path := fmt.Sprintf("/values/%d/%s", i, name)
+		c = c.WithFile(path, f)
+		args = append(args, "--values", path)
+	}
+	for _, s := range set {
+		args = append(args, "--set", s)
+	}
+	return c, args, nil
+}
+
+func withKubectlValidate(
+	container *dagger.Container,
+) *dagger.Container {
+	// @version policy=~0.4.0 resolved=0.4.0
+	return container.WithExec(inSh(`go install sigs.k8s.io/kubectl-validate@fac15fd6e47976df8585fe18a73246d78642eab9`))
+}
+
+func withPluto(
+	container *dagger.Container,
+) *dagger.Container {
+	return container.WithExec(inSh(`wget https://github.com/FairwindsOps/pluto/releases/download/v5.19.4/pluto_5.19.4_linux_amd64.tar.gz -O pluto.tgz && tar -zxvf pluto.tgz pluto && mv pluto /usr/bin/pluto && rm pluto.tgz`))
+}
+
+var templateErrorLocation = regexp.MustCompile(`([\w./-]+\.(?:yaml|yml|tpl|txt|json)):(\d+)`)
+
+func templateFindings(
+	ctx context.Context,
+	container *dagger.Container,
+) ([]*Finding, error) {
+	code, err := container.ExitCode(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if code == 0 {
+		return nil, nil
+	}
+	stderr, err := container.Stderr(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return m, nil
+	finding := &Finding{
+		Tool:     "helm",
+		Rule:     "template",
+		Severity: SEVERITY_ERROR,
+		Message:  strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(stderr), "Error:")),
+	}
+	if match := templateErrorLocation.FindStringSubmatch(stderr); match != nil {
+		finding.File = chartRelativePath(match[1])
+		finding.Line, _ = strconv.Atoi(match[2])
+	}
+	return []*Finding{finding}, nil
+}
+
+type kubectlValidateStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Details struct {
+		Name   string `json:"name"`
+		Kind   string `json:"kind"`
+		Causes []struct {
+			Message string `json:"message"`
+			Field   string `json:"field"`
+		} `json:"causes"`
+	} `json:"details"`
+}
+
+func parseKubectlValidate(
+	output string,
+) ([]*Finding, error) {
+	files := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(output), &files); err != nil {
+		return nil, fmt.Errorf("unexpected output from kubectl-validate: %w", err)
+	}
+
+	findings := []*Finding{}
+	for file, raw := range files {
+		statuses := []kubectlValidateStatus{}
+		if err := json.Unmarshal(raw, &statuses); err != nil {
+			status := kubectlValidateStatus{}
+			if err := json.Unmarshal(raw, &status); err != nil {
+				return nil, fmt.Errorf("unexpected output from kubectl-validate for %s: %w", file, err)
+			}
+			statuses = append(statuses, status)
+		}
+
+		for _, status := range statuses {
+			if status.Status == "" || status.Status == "Success" {
+				continue
+			}
+			finding := &Finding{
+				Tool:     "kubectl-validate",
+				Rule:     status.Reason,
+				Severity: SEVERITY_ERROR,
+				File:     chartRelativePath(file),
+				Kind:     status.Details.Kind,
+				Name:     status.Details.Name,
+				Message:  status.Message,
+			}
+			if len(status.Details.Causes) == 0 {
+				findings = append(findings, finding)
+				continue
+			}
+			for _, cause := range status.Details.Causes {
+				f := *finding
+				f.Message = cause.Message
+				if cause.Field != "" {
+					f.Message = cause.Field + ": " + cause.Message
+				}
+				findings = append(findings, &f)
+			}
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].File < findings[j].File })
+
+	return findings, nil
+}
+
+type plutoOutput struct {
+	Items []struct {
+		Name     string `json:"name"`
+		FilePath string `json:"filePath"`
+		Api      struct {
+			Version        string `json:"version"`
+			Kind           string `json:"kind"`
+			DeprecatedIn   string `json:"deprecated-in"`
+			RemovedIn      string `json:"removed-in"`
+			ReplacementApi string `json:"replacement-api"`
+		} `json:"api"`
+		Deprecated bool `json:"deprecated"`
+		Removed    bool `json:"removed"`
+	} `json:"items"`
+}
+
+func parsePluto(
+	output string,
+) ([]*Finding, error) {
+	findings := []*Finding{}
+	// pluto prints a plain message instead of JSON when nothing is found
+	if !strings.HasPrefix(strings.TrimSpace(output), "{") {
+		return findings, nil
+	}
+
+	result := plutoOutput{}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		return nil, fmt.Errorf("unexpected output from pluto: %w", err)
+	}
+
+	for _, item := range result.Items {
+		finding := &Finding{
+			Tool: "pluto",
+			File: chartRelativePath(item.FilePath),
+			Kind: item.Api.Kind,
+			Name: item.Name,
+		}
+		switch {
+		case item.Removed:
+			finding.Rule = "removed-api"
+			finding.Severity = SEVERITY_ERROR
+			finding.Message = fmt.Sprintf("%s is removed in %s", item.Api.Version, item.Api.RemovedIn)
+		case item.Deprecated:
+			finding.Rule = "deprecated-api"
+			finding.Severity = SEVERITY_WARNING
+			finding.Message = fmt.Sprintf("%s is deprecated in %s", item.Api.Version, item.Api.DeprecatedIn)
+		default:
+			continue
+		}
+		if item.Api.ReplacementApi != "" {
+			finding.Message += fmt.Sprintf(", use %s instead", item.Api.ReplacementApi)
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+// Map a templated file back to its path in the chart source,
+// e.g. /src/templated/mychart/templates/a.yaml to templates/a.yaml
+func chartRelativePath(
+	path string,
+) string {
+	path = strings.TrimPrefix(path, TEMPLATEDIR+"/")
+	path = strings.TrimPrefix(path, "templated/")
+	_, rest, ok := strings.Cut(path, "/")
+	if !ok {
+		return path
+	}
+	return rest
 }
 
 func (m *MikaelElkiaer) createHelmContainer(
@@ -349,7 +934,7 @@ func (m *MikaelElkiaer) createHelmContainer(
 			WithEnvVariable("__URL", cred.Url).
 			WithEnvVariable("__USERNAME", cred.UserId).
 			WithSecretVariable("__PASSWORD", cred.UserSecret).
-			WithExec(inSh(`echo $__PASSWORD | helm registry login --username $__USERNAME --password-stdin $__URL`)).
+			WithExec(inSh(`echo "$__PASSWORD" | helm registry login --username "$__USERNAME" --password-stdin "$__URL"`)).
 			WithoutSecretVariable("__PASSWORD").
 			WithoutEnvVariable("__USERNAME").
 			WithoutEnvVariable("__URL")
@@ -372,7 +957,7 @@ func withDockerPullSecrets(
 			WithEnvVariable("__URL", cred.Url).
 			WithEnvVariable("__USERNAME", cred.UserId).
 			WithSecretVariable("__PASSWORD", cred.UserSecret).
-			WithExec(inSh(`kubectl --namespace %s create secret docker-registry "${__NAME}" --docker-username="${__USERNAME}" --docker-password="${__PASSWORD}" --docker-email="" --docker-server="${__URL}" --dry-run=client --output=json | kubectl apply -f -`, namespace)).
+			WithExec(inSh(`kubectl --namespace "$1" create secret docker-registry "${__NAME}" --docker-username="${__USERNAME}" --docker-password="${__PASSWORD}" --docker-email="" --docker-server="${__URL}" --dry-run=client --output=json | kubectl apply -f -`, namespace)).
 			WithoutSecretVariable("__PASSWORD").
 			WithoutEnvVariable("__USERNAME").
 			WithoutEnvVariable("__URL").
@@ -434,3 +1019,101 @@ EOF`)).
 
 	return k3s.WithContainer(k3sContainer), nil
 }
+
+func ociHost(
+	registry string,
+) (string, error) {
+	rest, ok := strings.CutPrefix(registry, "oci://")
+	if !ok {
+		return "", fmt.Errorf("registry %s must start with oci://", registry)
+	}
+	host, _, _ := strings.Cut(rest, "/")
+	if host == "" {
+		return "", fmt.Errorf("registry %s has no host", registry)
+	}
+	return host, nil
+}
+
+func gitPrerelease(
+	ctx context.Context,
+	container *dagger.Container,
+	mode string,
+) (string, error) {
+	git := []string{"git", "-c", "safe.directory=*", "-C", "/git"}
+	switch mode {
+	case "describe":
+		out, err := container.WithExec(append(git, "describe", "--tags", "--long", "--always", "--abbrev=7")).Stdout(ctx)
+		if err != nil {
+			return "", err
+		}
+		return describeToPrerelease(strings.TrimSpace(out)), nil
+	case "sha":
+		out, err := container.WithExec(append(git, "rev-parse", "--short=7", "HEAD")).Stdout(ctx)
+		if err != nil {
+			return "", err
+		}
+		return "g" + strings.TrimSpace(out), nil
+	default:
+		return "", fmt.Errorf("unknown prerelease mode %s, expected describe or sha", mode)
+	}
+}
+
+// Turn `git describe --long` output, e.g. v1.2.0-5-gabc1234, into 5.gabc1234
+func describeToPrerelease(
+	describe string,
+) string {
+	parts := strings.Split(describe, "-")
+	if len(parts) < 3 {
+		// No tags, only the abbreviated commit
+		return "0.g" + describe
+	}
+	count := parts[len(parts)-2]
+	sha := parts[len(parts)-1]
+	return count + "." + sha
+}
+
+func appendPrerelease(
+	version string,
+	prerelease string,
+) string {
+	version, build, hasBuild := strings.Cut(version, "+")
+	if strings.Contains(version, "-") {
+		version += "." + prerelease
+	} else {
+		version += "-" + prerelease
+	}
+	if hasBuild {
+		version += "+" + build
+	}
+	return version
+}
+
+func parseHelmPush(
+	output string,
+) (*HelmPushResult, error) {
+	var pushed, digest string
+	for _, line := range strings.Split(output, "\n") {
+		if v, ok := strings.CutPrefix(line, "Pushed:"); ok {
+			pushed = strings.TrimSpace(v)
+		}
+		if v, ok := strings.CutPrefix(line, "Digest:"); ok {
+			digest = strings.TrimSpace(v)
+		}
+	}
+	if pushed == "" || digest == "" {
+		return nil, fmt.Errorf("unexpected output from helm push: %s", output)
+	}
+
+	i := strings.LastIndex(pushed, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("pushed reference %s has no version", pushed)
+	}
+	repository, version := pushed[:i], pushed[i+1:]
+
+	return &HelmPushResult{
+		Chart:     repository[strings.LastIndex(repository, "/")+1:],
+		Version:   version,
+		Digest:    digest,
+		Reference: repository + "@" + digest,
+	}, nil
+}
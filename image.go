@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const DOCKER_HUB = "docker.io"
+
+// Parsed container image reference, e.g. ghcr.io/owner/repo:1.0.0@sha256:...
+type imageRef struct {
+	// Name as written, without tag or digest
+	Name string
+	// Registry host, including port, e.g. docker.io or localhost:5000
+	Registry string
+	// Repository path in the registry, e.g. library/postgres
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+var (
+	imageNamePattern   = regexp.MustCompile(`^[a-zA-Z0-9.-]+(:[0-9]+)?(/[a-z0-9]+(([._]|__|-+)[a-z0-9]+)*)+$|^[a-z0-9]+(([._]|__|-+)[a-z0-9]+)*$`)
+	imageTagPattern    = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	imageDigestPattern = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+func parseImageRef(
+	s string,
+) (*imageRef, error) {
+	ref := &imageRef{}
+	rest := s
+
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		rest, ref.Digest = rest[:i], rest[i+1:]
+		if !imageDigestPattern.MatchString(ref.Digest) {
+			return nil, fmt.Errorf("invalid digest %q in image %q", ref.Digest, s)
+		}
+	}
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		rest, ref.Tag = rest[:i], rest[i+1:]
+		if !imageTagPattern.MatchString(ref.Tag) {
+			return nil, fmt.Errorf("invalid tag %q in image %q", ref.Tag, s)
+		}
+	}
+	if !imageNamePattern.MatchString(rest) {
+		return nil, fmt.Errorf("invalid image name %q", s)
+	}
+	ref.Name = rest
+
+	first, path, found := strings.Cut(rest, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		ref.Registry, ref.Repository = first, path
+	} else {
+		ref.Registry, ref.Repository = DOCKER_HUB, rest
+	}
+	if ref.Registry == DOCKER_HUB && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+
+	return ref, nil
+}
+
+// Fully qualified repository, e.g. docker.io/library/postgres
+func (r *imageRef) repository() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// Reference as written, with the given tag and digest
+func (r *imageRef) with(
+	tag string,
+	digest string,
+) string {
+	s := r.Name
+	if tag != "" {
+		s += ":" + tag
+	}
+	if digest != "" {
+		s += "@" + digest
+	}
+	return s
+}
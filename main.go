@@ -6,6 +6,7 @@ import (
 	"dagger/mikael-elkiaer/internal/dagger"
 	"encoding/hex"
 	"fmt"
+	"strings"
 )
 
 type MikaelElkiaer struct {
@@ -69,6 +70,33 @@ func (m *MikaelElkiaer) WithCred(
 	return m, nil
 }
 
+// Find the cred matching a registry host, if any
+func getCredByUrl(
+	creds []*Cred,
+	url string,
+) (*Cred, error) {
+	var cred *Cred
+	for _, c := range creds {
+		if trimUrl(c.Url) == trimUrl(url) {
+			if cred != nil {
+				return nil, fmt.Errorf("multiple creds with url %s found", url)
+			}
+			cred = c
+		}
+	}
+
+	return cred, nil
+}
+
+func trimUrl(
+	url string,
+) string {
+	for _, scheme := range []string{"https://", "http://", "oci://"} {
+		url = strings.TrimPrefix(url, scheme)
+	}
+	return strings.TrimSuffix(url, "/")
+}
+
 func downloadAsFile(
 	ctx context.Context,
 	uri string,
@@ -85,9 +113,11 @@ func downloadAsFile(
 		File(name)
 }
 
+// Run a fixed script in sh, passing args as positional parameters ($1, $2, ...)
+// Values must never be formatted into the script itself
 func inSh(
-	cmd string,
-	a ...any,
+	script string,
+	args ...string,
 ) []string {
-	return []string{"sh", "-c", fmt.Sprintf(cmd, a...)}
+	return append([]string{"sh", "-c", script, "sh"}, args...)
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"dagger/mikael-elkiaer/internal/dagger"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+const NUPKGDIR = "/nupkgs"
+
+// NuGet package produced by Pack
+type NugetPackage struct {
+	// Package ID
+	Id string
+	// Package version
+	Version string
+}
+
+// Pack NuGet packages of all packable projects
+func (m *Dotnet) Pack(
+	ctx context.Context,
+	// Also produce .snupkg symbol packages
+	// +default=false
+	symbols bool,
+	// Embed SourceLink information, requires the source to contain .git
+	// +default=false
+	sourceLink bool,
+	// Version to pack, overriding the project version and rebuilding
+	// +optional
+	version string,
+) (*Dotnet, error) {
+	args := []string{"dotnet", "pack", "--configuration", m.Configuration, "--no-restore", "--output", NUPKGDIR}
+	if version == "" {
+		args = append(args, "--no-build")
+	} else {
+		if _, err := semver.NewVersion(version); err != nil {
+			return nil, fmt.Errorf("invalid version %q: %w", version, err)
+		}
+		args = append(args, "/p:Version="+version)
+	}
+	if symbols {
+		args = append(args, "--include-symbols", "/p:SymbolPackageFormat=snupkg")
+	}
+	if sourceLink {
+		args = append(args, "/p:PublishRepositoryUrl=true", "/p:EmbedUntrackedSources=true", "/p:ContinuousIntegrationBuild=true")
+	}
+
+	m.Container = m.Base.
+		WithDirectory(WORKDIR, m.Container.Directory(WORKDIR)).
+		WithExec(args)
+
+	return m, nil
+}
+
+// Packages produced by Pack
+func (m *Dotnet) Packages(
+	ctx context.Context,
+) *dagger.Directory {
+	return m.Container.Directory(NUPKGDIR)
+}
+
+// Push packages produced by Pack, skipping versions already in the feed
+//
+// The API key is the secret of the given cred, or of the cred matching the source URL.
+// Returns every package that was attempted, including versions skipped as already in the feed.
+func (m *Dotnet) PushPackages(
+	ctx context.Context,
+	// Credential to use, its feed is used unless source is set
+	// A ghcr.io cred pushes to the GitHub Packages feed of its name, like WithNugetGhcr
+	// +optional
+	fromCred string,
+	// NuGet feed URL, e.g. https://nuget.pkg.github.com/owner/index.json
+	// +optional
+	source string,
+) ([]*NugetPackage, error) {
+	cred, source, err := pushSource(m.Module.Creds, fromCred, source)
+	if err != nil {
+		return nil, err
+	}
+
+	packages, err := m.packages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(packages) == 0 {
+		return nil, fmt.Errorf("no packages to push, run pack first")
+	}
+
+	c := m.Base.WithDirectory(NUPKGDIR, m.Container.Directory(NUPKGDIR))
+	if cred != nil {
+		c = c.
+			WithSecretVariable("__PASSWORD", cred.UserSecret).
+			WithExec(inSh(`dotnet nuget push "$1" --source "$2" --api-key "$__PASSWORD" --skip-duplicate`, NUPKGDIR+"/*.nupkg", source)).
+			WithoutSecretVariable("__PASSWORD")
+	} else {
+		c = c.WithExec([]string{"dotnet", "nuget", "push", NUPKGDIR + "/*.nupkg", "--source", source, "--skip-duplicate"})
+	}
+	if _, err := c.Sync(ctx); err != nil {
+		return nil, err
+	}
+
+	return packages, nil
+}
+
+// Cred and feed to push to, from a cred name, a feed URL, or both
+func pushSource(
+	creds []*Cred,
+	fromCred string,
+	source string,
+) (*Cred, string, error) {
+	var cred *Cred
+	var err error
+	if fromCred != "" {
+		cred, err = getCred(creds, fromCred)
+		if err != nil {
+			return nil, "", err
+		}
+		if source == "" {
+			source, err = credFeed(cred)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+	} else if source != "" {
+		cred, err = getCredByUrl(creds, source)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if source == "" {
+		return nil, "", fmt.Errorf("either fromCred or source is required")
+	}
+	if err := validateUrl("source", source); err != nil {
+		return nil, "", err
+	}
+	return cred, source, nil
+}
+
+// NuGet feed of a cred, its URL or the GitHub Packages feed for ghcr.io
+func credFeed(
+	cred *Cred,
+) (string, error) {
+	if strings.HasPrefix(cred.Url, "https://") || strings.HasPrefix(cred.Url, "http://") {
+		return cred.Url, nil
+	}
+	if cred.Url == "ghcr.io" {
+		return githubNugetFeed(cred.Name), nil
+	}
+	return "", fmt.Errorf("cred %s has no NuGet feed URL, set source", cred.Name)
+}
+
+// GitHub Packages NuGet feed of an owner
+func githubNugetFeed(
+	owner string,
+) string {
+	return fmt.Sprintf("https://nuget.pkg.github.com/%s/index.json", owner)
+}
+
+// IDs and versions of the packed packages, read from their nuspec
+func (m *Dotnet) packages(
+	ctx context.Context,
+) ([]*NugetPackage, error) {
+	// Nuspecs of all packages in one exec, separated by NUL
+	out, err := m.Base.
+		WithDirectory(NUPKGDIR, m.Container.Directory(NUPKGDIR)).
+		WithExec(inSh(`for f in "$1"/*.nupkg; do [ -e "$f" ] || continue; unzip -p "$f" '*.nuspec'; printf '\0'; done`, NUPKGDIR)).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	packages := []*NugetPackage{}
+	for _, nuspec := range strings.Split(out, "\x00") {
+		if strings.TrimSpace(nuspec) == "" {
+			continue
+		}
+		p, err := parseNuspec(nuspec)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, p)
+	}
+	return packages, nil
+}
+
+func parseNuspec(
+	contents string,
+) (*NugetPackage, error) {
+	nuspec := struct {
+		Id      string `xml:"metadata>id"`
+		Version string `xml:"metadata>version"`
+	}{}
+	if err := xml.Unmarshal([]byte(contents), &nuspec); err != nil {
+		return nil, fmt.Errorf("parsing nuspec: %w", err)
+	}
+	if nuspec.Id == "" || nuspec.Version == "" {
+		return nil, fmt.Errorf("nuspec without id or version")
+	}
+	return &NugetPackage{Id: nuspec.Id, Version: nuspec.Version}, nil
+}
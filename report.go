@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"dagger/mikael-elkiaer/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	SEVERITY_ERROR   = "error"
+	SEVERITY_WARNING = "warning"
+	SEVERITY_NOTE    = "note"
+)
+
+// Findings collected from one or more tools
+type Report struct {
+	Findings []*Finding
+}
+
+// Single problem reported by a tool
+type Finding struct {
+	// Tool that reported the finding
+	Tool string
+	// Values profile the finding applies to, in matrix mode
+	Profile string
+	// Tool specific rule or reason
+	Rule string
+	// One of error, warning, or note
+	Severity string
+	// File relative to the source, if known
+	File string
+	// Line in the file, if known
+	Line int
+	// Kind of the affected resource, if known
+	Kind string
+	// Name of the affected resource, if known
+	Name string
+	// Description of the problem
+	Message string
+}
+
+func (r *Report) add(
+	findings ...*Finding,
+) {
+	r.Findings = append(r.Findings, findings...)
+}
+
+// Number of findings with severity error
+func (r *Report) Errors(
+	ctx context.Context,
+) int {
+	n := 0
+	for _, f := range r.Findings {
+		if f.Severity == SEVERITY_ERROR {
+			n++
+		}
+	}
+	return n
+}
+
+// Fail if any finding has severity error
+func (r *Report) Assert(
+	ctx context.Context,
+) (*Report, error) {
+	errors := []string{}
+	for _, f := range r.Findings {
+		if f.Severity == SEVERITY_ERROR {
+			errors = append(errors, f.describe())
+		}
+	}
+	if len(errors) > 0 {
+		return nil, fmt.Errorf("%d error(s) found:\n%s", len(errors), strings.Join(errors, "\n"))
+	}
+	return r, nil
+}
+
+// Export findings as JSON
+func (r *Report) Json(
+	ctx context.Context,
+) (*dagger.File, error) {
+	findings := r.Findings
+	if findings == nil {
+		findings = []*Finding{}
+	}
+	b, err := json.MarshalIndent(findings, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return dag.File("report.json", string(b)), nil
+}
+
+// Export findings as SARIF 2.1.0, one run per tool
+func (r *Report) Sarif(
+	ctx context.Context,
+	// Path of the source within the repository, prefixed to file URIs
+	// Code scanning resolves URIs against the repository root, e.g. charts/my-chart
+	// +optional
+	pathPrefix string,
+) (*dagger.File, error) {
+	if strings.HasPrefix(pathPrefix, "/") || slices.Contains(strings.Split(pathPrefix, "/"), "..") {
+		return nil, fmt.Errorf("invalid pathPrefix %q: must be relative to the repository root", pathPrefix)
+	}
+	b, err := json.MarshalIndent(r.sarif(pathPrefix), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return dag.File("report.sarif", string(b)), nil
+}
+
+func (f *Finding) describe() string {
+	location := f.File
+	if f.Line > 0 {
+		location = fmt.Sprintf("%s:%d", location, f.Line)
+	}
+	resource := ""
+	if f.Kind != "" || f.Name != "" {
+		resource = fmt.Sprintf(" %s/%s", f.Kind, f.Name)
+	}
+	profile := ""
+	if f.Profile != "" {
+		profile = fmt.Sprintf(" (%s)", f.Profile)
+	}
+	return fmt.Sprintf("[%s]%s %s %s%s: %s", f.Tool, profile, f.Severity, location, resource, f.Message)
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	Id string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleId    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	Uri string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+func (r *Report) sarif(
+	pathPrefix string,
+) *sarifLog {
+	log := &sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{},
+	}
+
+	runs := map[string]int{}
+	rules := map[string]bool{}
+	for _, f := range r.Findings {
+		i, ok := runs[f.Tool]
+		if !ok {
+			i = len(log.Runs)
+			runs[f.Tool] = i
+			log.Runs = append(log.Runs, sarifRun{
+				Tool:    sarifTool{Driver: sarifDriver{Name: f.Tool, Rules: []sarifRule{}}},
+				Results: []sarifResult{},
+			})
+		}
+		run := &log.Runs[i]
+
+		rule := f.Rule
+		if rule == "" {
+			rule = f.Tool
+		}
+		if !rules[f.Tool+"/"+rule] {
+			rules[f.Tool+"/"+rule] = true
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{Id: rule})
+		}
+
+		message := f.Message
+		if f.Kind != "" || f.Name != "" {
+			message = fmt.Sprintf("%s/%s: %s", f.Kind, f.Name, message)
+		}
+		if f.Profile != "" {
+			message = fmt.Sprintf("[%s] %s", f.Profile, message)
+		}
+		result := sarifResult{
+			RuleId:  rule,
+			Level:   f.Severity,
+			Message: sarifMessage{Text: message},
+		}
+		if f.File != "" {
+			location := sarifLocation{PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{Uri: path.Join(pathPrefix, f.File)}}}
+			if f.Line > 0 {
+				location.PhysicalLocation.Region = &sarifRegion{StartLine: f.Line}
+			}
+			result.Locations = []sarifLocation{location}
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	return log
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"dagger/mikael-elkiaer/internal/dagger"
+	"fmt"
+	"strings"
+)
+
+// Directory of the app in runtime images
+const APPDIR = "/app"
+
+// Path checked by the healthcheck unless configured otherwise
+const HEALTHCHECK = "/healthz"
+
+// Runtime image configuration of BuildContainer
+type DotnetRuntime struct {
+	// Base image, defaults to the channel's aspnet or runtime-deps image
+	BaseImage string
+	// Own Dockerfile, replacing all other configuration
+	Dockerfile *dagger.File
+	// Environment variables as NAME=value
+	Env []string
+	// HTTP path checked by the healthcheck, empty to disable
+	Healthcheck string
+	// Alpine packages to install
+	Packages []string
+	// Ports to expose, the first one is used by the healthcheck
+	Ports []int
+	// User to run as, defaults to app for the channel images
+	User string
+}
+
+// Configure the runtime image built by BuildContainer
+func (m *Dotnet) WithRuntime(
+	ctx context.Context,
+	// Base image, defaults to the channel's aspnet or runtime-deps image depending on the publish mode
+	// +optional
+	baseImage string,
+	// Own Dockerfile, built with the published app in ./app/$PROJECT_NAME
+	// Cannot be combined with other options
+	// +optional
+	dockerfile *dagger.File,
+	// Environment variables as NAME=value
+	// +optional
+	env []string,
+	// HTTP path checked by the healthcheck, empty to disable, e.g. for worker services
+	// Must be left at its default with a dockerfile, which sets its own HEALTHCHECK
+	// +default="/healthz"
+	healthcheck string,
+	// Alpine packages to install, e.g. bash or icu-libs
+	// +optional
+	packages []string,
+	// Ports to expose, the first one is used by the healthcheck
+	// Defaults to 8080 for the healthcheck, exposing none
+	// +optional
+	ports []int,
+	// User to run as, defaults to app for the channel images and the base image's user otherwise
+	// +optional
+	user string,
+) (*Dotnet, error) {
+	if dockerfile != nil && (baseImage != "" || len(env) > 0 || len(packages) > 0 || len(ports) > 0 || user != "") {
+		return nil, fmt.Errorf("dockerfile cannot be combined with other runtime options")
+	}
+	if dockerfile != nil {
+		// Dagger cannot tell the default from a given value, so only another path is rejected
+		if healthcheck != HEALTHCHECK {
+			return nil, fmt.Errorf("dockerfile cannot be combined with healthcheck, set a HEALTHCHECK in the dockerfile instead")
+		}
+		healthcheck = ""
+	}
+	if baseImage != "" {
+		if _, err := parseImageRef(baseImage); err != nil {
+			return nil, err
+		}
+	}
+	if healthcheck != "" && !strings.HasPrefix(healthcheck, "/") {
+		return nil, fmt.Errorf("invalid healthcheck %q: must be a path starting with /", healthcheck)
+	}
+	for _, e := range env {
+		name, _, ok := strings.Cut(e, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid env %q: must be NAME=value", e)
+		}
+		if err := validateIdentifier("environment variable", name); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range packages {
+		if err := validateIdentifier("package", p); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range ports {
+		if p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid port %d", p)
+		}
+	}
+
+	m.Runtime = &DotnetRuntime{
+		BaseImage:   baseImage,
+		Dockerfile:  dockerfile,
+		Env:         env,
+		Healthcheck: healthcheck,
+		Packages:    packages,
+		Ports:       ports,
+		User:        user,
+	}
+	return m, nil
+}
+
+// Runtime configuration, matching the former Dockerfile if not configured
+func (m *Dotnet) runtime() *DotnetRuntime {
+	if m.Runtime != nil {
+		return m.Runtime
+	}
+	r := &DotnetRuntime{Healthcheck: HEALTHCHECK}
+	if m.PublishMode == "framework-dependent" {
+		r.Packages = []string{"bash"}
+	}
+	return r
+}
+
+// Assemble the runtime image of a published project
+func (m *Dotnet) buildContainer(
+	source *dagger.Directory,
+	images *dotnetImages,
+	platform dagger.Platform,
+	project string,
+	tag string,
+) *dagger.Container {
+	r := m.runtime()
+	var c *dagger.Container
+
+	if r.Dockerfile != nil {
+		c = source.
+			WithFile("Dockerfile", r.Dockerfile).
+			DockerBuild(dagger.DirectoryDockerBuildOpts{
+				BuildArgs: []dagger.BuildArg{
+					{Name: "ASPNET_IMAGE", Value: images.aspnet},
+					{Name: "PROJECT_NAME", Value: project},
+					{Name: "RUNTIME_DEPS_IMAGE", Value: images.runtimeDeps},
+				},
+				Platform: platform,
+			})
+	} else {
+		base, user := r.BaseImage, r.User
+		if base == "" {
+			base = images.runtimeDeps
+			if m.PublishMode == "framework-dependent" {
+				base = images.aspnet
+			}
+			if user == "" {
+				// Created by the .NET images, with APP_UID as its ID
+				user = "app"
+			}
+		}
+
+		if r.Healthcheck != "" {
+			port := 8080
+			if len(r.Ports) > 0 {
+				port = r.Ports[0]
+			}
+			// Dagger v0.19.7 has no API to set a healthcheck on a container, while
+			// DockerBuild keeps the HEALTHCHECK of a Dockerfile in the image config.
+			// So the base image is wrapped in a generated one-line Dockerfile and
+			// everything else is still done with the container API.
+			c = dag.Directory().
+				WithNewFile("Dockerfile", fmt.Sprintf("FROM %s\nHEALTHCHECK --interval=1s --timeout=500ms --start-period=500ms --retries=30 CMD wget --no-verbose --tries=1 --spider http://127.0.0.1:%d%s || exit 1\n", base, port, r.Healthcheck)).
+				DockerBuild(dagger.DirectoryDockerBuildOpts{Platform: platform})
+		} else {
+			c = dag.Container(dagger.ContainerOpts{Platform: platform}).From(base)
+		}
+
+		if len(r.Packages) > 0 {
+			c = c.WithExec(append([]string{"apk", "add", "--no-cache"}, r.Packages...))
+		}
+		owner := ""
+		if user != "" {
+			owner = user + ":" + user
+		}
+		c = c.
+			WithWorkdir(APPDIR).
+			WithEnvVariable("PROJECT_NAME", project).
+			WithDirectory(APPDIR, source.Directory("app/"+project), dagger.ContainerWithDirectoryOpts{Owner: owner})
+		for _, e := range r.Env {
+			name, value, _ := strings.Cut(e, "=")
+			c = c.WithEnvVariable(name, value)
+		}
+		for _, port := range r.Ports {
+			c = c.WithExposedPort(port)
+		}
+		if user != "" {
+			c = c.WithUser(user)
+		}
+		if m.PublishMode == "framework-dependent" {
+			c = c.WithEntrypoint([]string{"dotnet", project + ".dll"})
+		} else {
+			c = c.WithEntrypoint([]string{"./" + project})
+		}
+	}
+
+	if tag != "" {
+		c = c.WithAnnotation("io.containerd.image.name", tag)
+	}
+
+	return c
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"dagger/mikael-elkiaer/internal/dagger"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// CycloneDX SBOM of the NuGet packages restored for an entrypoint project
+func (m *Dotnet) sbom(
+	ctx context.Context,
+	created string,
+	project string,
+	name string,
+	version string,
+) (*dagger.File, error) {
+	file := path.Join(WORKDIR, project, "obj", "project.assets.json")
+	contents, err := m.Container.File(file).Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s, has the project been restored: %w", file, err)
+	}
+	assets := &projectAssets{}
+	if err := json.Unmarshal([]byte(contents), assets); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+
+	bom, err := json.MarshalIndent(assets.cycloneDx(created, name, version), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return dag.File("sbom.cdx.json", string(bom)), nil
+}
+
+type projectAssets struct {
+	// Packages per target framework and runtime, keyed by name/version
+	Targets map[string]map[string]struct {
+		Type         string
+		Dependencies map[string]string
+	}
+	Libraries map[string]struct {
+		Type   string
+		Sha512 string
+	}
+	Project struct {
+		Frameworks map[string]struct {
+			Dependencies map[string]json.RawMessage
+		}
+	}
+}
+
+type cycloneDx struct {
+	BomFormat    string                 `json:"bomFormat"`
+	SpecVersion  string                 `json:"specVersion"`
+	Version      int                    `json:"version"`
+	Metadata     cycloneDxMetadata      `json:"metadata"`
+	Components   []*cycloneDxComponent  `json:"components"`
+	Dependencies []*cycloneDxDependency `json:"dependencies"`
+}
+
+type cycloneDxMetadata struct {
+	// Creation time, omitted if not given to keep the SBOM reproducible
+	Timestamp string              `json:"timestamp,omitempty"`
+	Component *cycloneDxComponent `json:"component"`
+}
+
+type cycloneDxComponent struct {
+	Type    string          `json:"type"`
+	BomRef  string          `json:"bom-ref"`
+	Name    string          `json:"name"`
+	Version string          `json:"version,omitempty"`
+	Purl    string          `json:"purl,omitempty"`
+	Hashes  []cycloneDxHash `json:"hashes,omitempty"`
+}
+
+type cycloneDxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cycloneDxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+func (a *projectAssets) cycloneDx(
+	created string,
+	name string,
+	version string,
+) *cycloneDx {
+	app := &cycloneDxComponent{Type: "application", BomRef: name, Name: name, Version: version}
+	bom := &cycloneDx{
+		BomFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		Version:      1,
+		Metadata:     cycloneDxMetadata{Timestamp: created, Component: app},
+		Components:   []*cycloneDxComponent{},
+		Dependencies: []*cycloneDxDependency{},
+	}
+
+	// Package keys by lower case name, NuGet names are case-insensitive
+	packages := map[string]string{}
+	for key, library := range a.Libraries {
+		if library.Type != "package" {
+			continue
+		}
+		id, v, _ := strings.Cut(key, "/")
+		packages[strings.ToLower(id)] = key
+
+		component := &cycloneDxComponent{Type: "library", BomRef: nugetPurl(key), Name: id, Version: v, Purl: nugetPurl(key)}
+		if hash, err := base64.StdEncoding.DecodeString(library.Sha512); err == nil && len(hash) > 0 {
+			component.Hashes = []cycloneDxHash{{Alg: "SHA-512", Content: hex.EncodeToString(hash)}}
+		}
+		bom.Components = append(bom.Components, component)
+	}
+	slices.SortFunc(bom.Components, func(a, b *cycloneDxComponent) int {
+		return strings.Compare(a.BomRef, b.BomRef)
+	})
+
+	direct := []string{}
+	for _, framework := range a.Project.Frameworks {
+		for id := range framework.Dependencies {
+			if key, ok := packages[strings.ToLower(id)]; ok && !slices.Contains(direct, nugetPurl(key)) {
+				direct = append(direct, nugetPurl(key))
+			}
+		}
+	}
+	slices.Sort(direct)
+	bom.Dependencies = append(bom.Dependencies, &cycloneDxDependency{Ref: app.BomRef, DependsOn: direct})
+
+	dependsOn := map[string][]string{}
+	for _, target := range a.Targets {
+		for key, entry := range target {
+			if entry.Type != "package" {
+				continue
+			}
+			ref := nugetPurl(key)
+			if _, ok := dependsOn[ref]; !ok {
+				dependsOn[ref] = []string{}
+			}
+			for id := range entry.Dependencies {
+				if dep, ok := packages[strings.ToLower(id)]; ok && !slices.Contains(dependsOn[ref], nugetPurl(dep)) {
+					dependsOn[ref] = append(dependsOn[ref], nugetPurl(dep))
+				}
+			}
+		}
+	}
+	for _, c := range bom.Components {
+		deps := dependsOn[c.BomRef]
+		if deps == nil {
+			deps = []string{}
+		}
+		slices.Sort(deps)
+		bom.Dependencies = append(bom.Dependencies, &cycloneDxDependency{Ref: c.BomRef, DependsOn: deps})
+	}
+
+	return bom
+}
+
+// Package URL of a name/version key, e.g. pkg:nuget/Serilog@4.0.0
+func nugetPurl(
+	key string,
+) string {
+	id, version, _ := strings.Cut(key, "/")
+	return fmt.Sprintf("pkg:nuget/%s@%s", id, version)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"dagger/mikael-elkiaer/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// Images of a .NET channel
+type dotnetImages struct {
+	sdk         string
+	aspnet      string
+	runtimeDeps string
+}
+
+// Images per .NET channel, Renovate keeps the digests up to date within a channel
+var dotnetChannels = map[string]*dotnetImages{
+	"8.0": {
+		sdk:         "mcr.microsoft.com/dotnet/sdk:8.0-alpine",
+		aspnet:      "mcr.microsoft.com/dotnet/aspnet:8.0-alpine",
+		runtimeDeps: "mcr.microsoft.com/dotnet/runtime-deps:8.0-alpine",
+	},
+	"9.0": {
+		sdk:         "mcr.microsoft.com/dotnet/sdk:9.0-alpine",
+		aspnet:      "mcr.microsoft.com/dotnet/aspnet:9.0-alpine",
+		runtimeDeps: "mcr.microsoft.com/dotnet/runtime-deps:9.0-alpine",
+	},
+	"10.0": {
+		sdk:         "mcr.microsoft.com/dotnet/sdk:10.0-alpine@sha256:940f919ae84dd92ccd4aab7686fa5b777870b006c9360351039e16bcaad73d89",
+		aspnet:      "mcr.microsoft.com/dotnet/aspnet:10.0-alpine@sha256:57bd717ac18ff6c8a39cc0ee4a76c1f15adc46df50434c73eff0c3f1df4c88f0",
+		runtimeDeps: "mcr.microsoft.com/dotnet/runtime-deps:10.0-alpine",
+	},
+}
+
+// Channel used when neither global.json nor any project decides
+const DEFAULT_DOTNET_CHANNEL = "10.0"
+
+var targetFrameworkPattern = regexp.MustCompile(`^net([0-9]+)\.([0-9]+)(-.+)?$`)
+
+// Images of a known channel
+func channelImages(
+	channel string,
+) (*dotnetImages, error) {
+	images, ok := dotnetChannels[channel]
+	if !ok {
+		return nil, fmt.Errorf("no images for .NET channel %s, must be one of %s", channel, strings.Join(knownChannels(), ", "))
+	}
+	return images, nil
+}
+
+// Known channels, oldest first
+func knownChannels() []string {
+	channels := make([]string, 0, len(dotnetChannels))
+	for channel := range dotnetChannels {
+		channels = append(channels, channel)
+	}
+	slices.SortFunc(channels, func(a, b string) int {
+		return semver.MustParse(a).Compare(semver.MustParse(b))
+	})
+	return channels
+}
+
+// Channel of a target framework, e.g. 8.0 for net8.0, empty for netstandard and the like
+func frameworkChannel(
+	framework string,
+) string {
+	match := targetFrameworkPattern.FindStringSubmatch(strings.TrimSpace(framework))
+	if match == nil {
+		return ""
+	}
+	return match[1] + "." + match[2]
+}
+
+// Newest channel of the target frameworks, empty if there is none
+func newestFrameworkChannel(
+	frameworks []string,
+) string {
+	newest := ""
+	for _, framework := range frameworks {
+		channel := frameworkChannel(framework)
+		if channel != "" && (newest == "" || semver.MustParse(channel).GreaterThan(semver.MustParse(newest))) {
+			newest = channel
+		}
+	}
+	return newest
+}
+
+// SDK channel from an override, global.json or the newest target framework
+//
+// The SDK version of global.json is rolled forward to a known channel as its
+// rollForward policy allows. Without either, the lowest known channel at or
+// above the newest target framework is used. The result must be able to build
+// every target framework.
+func sdkChannel(
+	override string,
+	globalJson string,
+	frameworks []string,
+) (string, error) {
+	minimum := newestFrameworkChannel(frameworks)
+	channel := override
+
+	if channel == "" && globalJson != "" {
+		global := struct {
+			Sdk struct {
+				Version     string
+				RollForward string
+			}
+		}{}
+		if err := json.Unmarshal([]byte(globalJson), &global); err != nil {
+			return "", fmt.Errorf("parsing global.json: %w", err)
+		}
+		if global.Sdk.Version != "" {
+			var err error
+			channel, err = rollForward(global.Sdk.Version, global.Sdk.RollForward, minimum)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	if channel == "" && minimum == "" {
+		channel = DEFAULT_DOTNET_CHANNEL
+	}
+	if channel == "" {
+		// Newer SDKs build older target frameworks, only the runtime image must match exactly
+		for _, known := range knownChannels() {
+			if !semver.MustParse(known).LessThan(semver.MustParse(minimum)) {
+				channel = known
+				break
+			}
+		}
+		if channel == "" {
+			return "", fmt.Errorf("no known .NET SDK can build net%s, must be one of %s", minimum, strings.Join(knownChannels(), ", "))
+		}
+	}
+
+	if _, err := channelImages(channel); err != nil {
+		return "", err
+	}
+	if minimum != "" && semver.MustParse(channel).LessThan(semver.MustParse(minimum)) {
+		return "", fmt.Errorf(".NET SDK %s cannot build net%s", channel, minimum)
+	}
+	return channel, nil
+}
+
+// Known channel for an SDK version and rollForward policy
+func rollForward(
+	version string,
+	policy string,
+	minimum string,
+) (string, error) {
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return "", fmt.Errorf("invalid SDK version %q in global.json: %w", version, err)
+	}
+	requested := semver.MustParse(fmt.Sprintf("%d.%d", v.Major(), v.Minor()))
+
+	candidates := []string{}
+	for _, channel := range knownChannels() {
+		c := semver.MustParse(channel)
+		allowed := false
+		switch policy {
+		// Default when a version is given, feature bands stay within the channel
+		case "", "patch", "feature", "latestPatch", "latestFeature", "disable":
+			allowed = c.Equal(requested)
+		case "minor", "latestMinor":
+			allowed = c.Major() == requested.Major() && !c.LessThan(requested)
+		case "major", "latestMajor":
+			allowed = !c.LessThan(requested)
+		default:
+			return "", fmt.Errorf("invalid rollForward %q in global.json", policy)
+		}
+		if allowed && (minimum == "" || !c.LessThan(semver.MustParse(minimum))) {
+			candidates = append(candidates, channel)
+		}
+	}
+	if len(candidates) == 0 {
+		if minimum != "" {
+			return "", fmt.Errorf("no known .NET channel satisfies SDK %s with rollForward %q and can build net%s", version, policy, minimum)
+		}
+		return "", fmt.Errorf("no known .NET channel satisfies SDK %s with rollForward %q, must be one of %s", version, policy, strings.Join(knownChannels(), ", "))
+	}
+
+	// Plain policies take the lowest match, latest* the highest
+	if strings.HasPrefix(policy, "latest") {
+		return candidates[len(candidates)-1], nil
+	}
+	return candidates[0], nil
+}
+
+// Target frameworks of all projects in a source directory
+func targetFrameworks(
+	ctx context.Context,
+	source *dagger.Directory,
+) ([]string, error) {
+	files, err := source.Glob(ctx, "**/*.csproj")
+	if err != nil {
+		return nil, err
+	}
+	frameworks := []string{}
+	for _, file := range files {
+		project, err := readCsproj(ctx, source, file)
+		if err != nil {
+			return nil, err
+		}
+		frameworks = append(frameworks, project.frameworks()...)
+	}
+	return frameworks, nil
+}
+
+// Contents of global.json, empty if there is none
+func globalJson(
+	ctx context.Context,
+	source *dagger.Directory,
+) (string, error) {
+	files, err := source.Glob(ctx, "global.json")
+	if err != nil || len(files) == 0 {
+		return "", err
+	}
+	return source.File("global.json").Contents(ctx)
+}
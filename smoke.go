@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"dagger/mikael-elkiaer/internal/dagger"
+	_ "embed"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed assets/smoke-test.sh
+var smoke_test__sh string
+
+var probePattern = regexp.MustCompile(`^/\S*=[1-5][0-9][0-9]$`)
+
+// Run the image as a service and check that it becomes healthy
+//
+// Fails with the probe results and the container logs.
+func (m *Dotnet) SmokeTest(
+	ctx context.Context,
+	// Path that must return 200 once the app is up
+	// +default="/healthz"
+	path string,
+	// Port the app listens on
+	// +default=8080
+	port int,
+	// Additional HTTP probes as <path>=<status>, e.g. /api/missing=404
+	// +optional
+	probes []string,
+	// Entrypoint project to test
+	// Required if there are multiple entrypoint projects
+	// +optional
+	project string,
+	// Time to wait for the app to become healthy
+	// +default="60s"
+	timeout string,
+) (string, error) {
+	if err := validateDuration("timeout", timeout); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("invalid path %q: must start with /", path)
+	}
+	for _, probe := range probes {
+		if !probePattern.MatchString(probe) {
+			return "", fmt.Errorf("invalid probe %q: must be <path>=<status>, e.g. /api/missing=404", probe)
+		}
+	}
+	wait, _ := time.ParseDuration(timeout)
+
+	image, err := m.BuildContainer(ctx, "", nil, project, "", "", "", "")
+	if err != nil {
+		return "", err
+	}
+	app := image.Variants[0].WithExposedPort(port)
+
+	service, err := app.AsService(dagger.ContainerAsServiceOpts{UseEntrypoint: true}).Start(ctx)
+	if err != nil {
+		return "", smokeTestError(ctx, app, wait, fmt.Sprintf("app did not listen on port %d: %s", port, err))
+	}
+	defer service.Stop(ctx)
+
+	c := dag.Container().
+		From("docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b").
+		WithExec([]string{"apk", "add", "--no-cache", "curl"}).
+		WithNewFile("/smoke-test.sh", smoke_test__sh).
+		WithServiceBinding("app", service).
+		WithEnvVariable("CACHE_BUST", time.Now().String()).
+		WithExec(append([]string{"sh", "/smoke-test.sh", fmt.Sprintf("http://app:%d", port), path, strconv.Itoa(int(wait.Seconds()))}, probes...), dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+
+	code, err := c.ExitCode(ctx)
+	if err != nil {
+		return "", err
+	}
+	out, err := c.Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+	if code != 0 {
+		return "", smokeTestError(ctx, app, wait, out)
+	}
+
+	return out, nil
+}
+
+// Error with the logs of a re-run of the app, for as long as it was given to become healthy
+//
+// The output of the service itself cannot be read back, so the logs come from
+// running the entrypoint again in a plain exec and may differ from the failed run.
+func smokeTestError(
+	ctx context.Context,
+	app *dagger.Container,
+	wait time.Duration,
+	reason string,
+) error {
+	entrypoint, err := app.Entrypoint(ctx)
+	if err != nil {
+		return fmt.Errorf("smoke test failed: %s", reason)
+	}
+	logs, err := app.
+		WithEnvVariable("CACHE_BUST", time.Now().String()).
+		WithExec(inSh(`seconds="$1"; shift; timeout "$seconds" "$@" 2>&1; true`, append([]string{strconv.Itoa(int(wait.Seconds()))}, entrypoint...)...), dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny}).
+		Stdout(ctx)
+	if err != nil {
+		return fmt.Errorf("smoke test failed: %s\ncould not capture logs of a re-run: %w", reason, err)
+	}
+	return fmt.Errorf("smoke test failed: %s\nlogs of a re-run of the app for %s, not of the failed run:\n%s", strings.TrimSpace(reason), wait, logs)
+}
@@ -2,8 +2,17 @@ package main
 
 import (
 	"context"
+	"dagger/mikael-elkiaer/internal/dagger"
 	_ "embed"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
 	"time"
+
+	"github.com/Masterminds/semver/v3"
 )
 
 type Testing struct {
@@ -31,3 +40,1136 @@ func (m *Testing) Interrupt(
 		WithExec([]string{"sh", "/interrupt.sh"}).
 		Stdout(ctx)
 }
+
+// Push a packaged chart to a local registry requiring auth
+func (m *Testing) HelmPush(
+	ctx context.Context,
+) (string, error) {
+	password := dag.SetSecret("registry-password", "secret")
+	registry := authRegistry()
+
+	mod := m.module()
+	chart := dag.Container().
+		From("docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b").
+		WithExec([]string{"apk", "add", "--no-cache", "helm"}).
+		WithExec([]string{"helm", "create", "/testchart"}).
+		Directory("/testchart")
+	h, err := mod.Helm(ctx, chart, "1.29")
+	if err != nil {
+		return "", err
+	}
+	_, err = mod.WithCred("test", "registry:5000", "test", password)
+	if err != nil {
+		return "", err
+	}
+	h.Base = h.Base.WithServiceBinding("registry", registry)
+
+	h, err = h.Package(ctx, "", nil, "", "")
+	if err != nil {
+		return "", err
+	}
+	pushed, err := h.Push(ctx, true, "oci://registry:5000/charts")
+	if err != nil {
+		return "", err
+	}
+
+	if pushed.Chart != "testchart" || pushed.Version != "0.1.0" {
+		return "", fmt.Errorf("unexpected chart pushed: %s:%s", pushed.Chart, pushed.Version)
+	}
+	_, err = h.Base.
+		WithExec([]string{"helm", "pull", "--plain-http", "oci://registry:5000/charts/testchart", "--version", pushed.Version}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeFailure}).
+		Sync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("pulling without login should fail: %w", err)
+	}
+
+	return pushed.Reference, nil
+}
+
+// Fresh module sharing the CAs of the main one
+func (m *Testing) module() *MikaelElkiaer {
+	return &MikaelElkiaer{AdditionalCAs: m.Main.AdditionalCAs}
+}
+
+// Registry requiring login as test with password secret
+func authRegistry() *dagger.Service {
+	htpasswd := dag.Container().
+		From("docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b").
+		WithExec([]string{"apk", "add", "--no-cache", "apache2-utils"}).
+		WithExec([]string{"htpasswd", "-Bbc", "/htpasswd", "test", "secret"}).
+		File("/htpasswd")
+	return dag.Container().
+		From("docker.io/library/registry:3.1.1@sha256:1be55279f18a2fe1a74edf2664cac61c1bea305b7b4642dab412e7affdcb3e33").
+		WithFile("/auth/htpasswd", htpasswd).
+		WithEnvVariable("REGISTRY_AUTH", "htpasswd").
+		WithEnvVariable("REGISTRY_AUTH_HTPASSWD_REALM", "test").
+		WithEnvVariable("REGISTRY_AUTH_HTPASSWD_PATH", "/auth/htpasswd").
+		WithExposedPort(5000).
+		AsService()
+}
+
+// Solution with a web app answering / and /healthz
+func dotnetWebApp() *dagger.Directory {
+	return dag.Container().
+		From("mcr.microsoft.com/dotnet/sdk:10.0-alpine@sha256:940f919ae84dd92ccd4aab7686fa5b777870b006c9360351039e16bcaad73d89").
+		WithWorkdir("/src").
+		WithExec([]string{"dotnet", "new", "web", "--name", "Web", "--output", "Web"}).
+		WithNewFile("Web/Program.cs", `var builder = WebApplication.CreateBuilder(args);
+var app = builder.Build();
+app.MapGet("/", () => "Hello World!");
+app.MapGet("/healthz", () => "ok");
+app.Run();
+`).
+		WithExec([]string{"dotnet", "new", "sln", "--name", "Web", "--format", "sln"}).
+		WithExec([]string{"dotnet", "sln", "add", "Web"}).
+		Directory("/src")
+}
+
+// Push a multi-platform image with version tags to a local registry requiring auth
+func (m *Testing) PublishImage(
+	ctx context.Context,
+) ([]string, error) {
+	registry := authRegistry()
+
+	mod := m.module()
+	_, err := mod.WithCred("test", "registry:5000", "test", dag.SetSecret("registry-password", "secret"))
+	if err != nil {
+		return nil, err
+	}
+	d, err := mod.Dotnet(ctx, "", "Release", "Web", nil, dotnetWebApp())
+	if err != nil {
+		return nil, err
+	}
+	d, err = d.Restore(ctx, "**/*.csproj", nil, "*.sln")
+	if err != nil {
+		return nil, err
+	}
+	d, err = d.Build(ctx, false).Publish(ctx, "framework-dependent", false, "")
+	if err != nil {
+		return nil, err
+	}
+	// Without packages nothing runs on the target platforms
+	d, err = d.WithRuntime(ctx, "", nil, nil, "/healthz", nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	d.Publisher = d.Publisher.WithServiceBinding("registry", registry)
+
+	keys := publishContainer().
+		WithEnvVariable("COSIGN_PASSWORD", "key-password").
+		WithWorkdir("/keys").
+		WithExec([]string{"cosign", "generate-key-pair"})
+	key, err := keys.File("cosign.key").Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := d.PublishImage(ctx, "", true, []dagger.Platform{"linux/amd64", "linux/arm64"}, "", "registry:5000/app", "0123abc", dag.SetSecret("cosign-key", key), dag.SetSecret("cosign-password", "key-password"), "", []string{"latest"}, false, "1.2.3")
+	if err != nil {
+		return nil, err
+	}
+
+	want := []string{"1.2.3", "1.2", "1", "0123abc", "latest"}
+	if len(refs) != len(want) {
+		return nil, fmt.Errorf("expected %d references, got %v", len(want), refs)
+	}
+	_, digest, _ := strings.Cut(refs[0], "@")
+	for i, tag := range want {
+		if refs[i] != "registry:5000/app:"+tag+"@"+digest {
+			return nil, fmt.Errorf("unexpected reference %s, expected tag %s with digest %s", refs[i], tag, digest)
+		}
+	}
+	_, err = publishContainer().
+		WithServiceBinding("registry", registry).
+		WithExec([]string{"skopeo", "inspect", "--raw", "--tls-verify=false", "docker://registry:5000/app:1.2.3"}, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeFailure}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("inspecting without login should fail: %w", err)
+	}
+
+	// Signed with the generated key, without a transparency log entry
+	_, err = publishContainer().
+		WithServiceBinding("registry", registry).
+		WithFile("/cosign.pub", keys.File("cosign.pub")).
+		WithEnvVariable("CACHE_BUST", time.Now().String()).
+		WithExec(inSh(`echo secret | skopeo login --tls-verify=false --username test --password-stdin registry:5000`)).
+		WithExec([]string{"cosign", "verify", "--key", "/cosign.pub", "--insecure-ignore-tlog=true", "--allow-http-registry", "registry:5000/app@" + digest}).
+		Sync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("verifying the signature: %w", err)
+	}
+
+	for _, tags := range [][]string{
+		{},
+		{"not a tag"},
+	} {
+		if _, err := imageTags("", tags, ""); err == nil {
+			return nil, fmt.Errorf("expected tags %v to be rejected", tags)
+		}
+	}
+	if tags, err := imageTags("", nil, "2.0.0-rc.1+build.5"); err != nil || !slices.Equal(tags, []string{"2.0.0-rc.1_build.5"}) {
+		return nil, fmt.Errorf("expected prerelease to only be tagged as is, got %v: %v", tags, err)
+	}
+
+	return refs, nil
+}
+
+// Pack a library and push it twice to a local NuGet server requiring an API key
+func (m *Testing) NugetPush(
+	ctx context.Context,
+) (string, error) {
+	// Minimal feed requiring the API key, answering 409 for versions it already has
+	nuget := dag.Container().
+		From("mcr.microsoft.com/dotnet/sdk:10.0-alpine@sha256:940f919ae84dd92ccd4aab7686fa5b777870b006c9360351039e16bcaad73d89").
+		WithWorkdir("/src").
+		WithExec([]string{"dotnet", "new", "web", "--name", "Nuget", "--output", "."}).
+		WithNewFile("Program.cs", `using System.IO.Compression;
+using System.Xml.Linq;
+
+var app = WebApplication.Create(args);
+var pushed = new List<string>();
+
+app.MapGet("/v3/index.json", () => Results.Json(new
+{
+    version = "3.0.0",
+    resources = new[] { new Dictionary<string, string> { ["@id"] = "http://nuget:8080/api/v2/package", ["@type"] = "PackagePublish/2.0.0" } },
+}));
+app.MapPut("/api/v2/package", async (HttpRequest request) =>
+{
+    if (request.Headers["X-NuGet-ApiKey"] != "test-key")
+    {
+        return Results.Unauthorized();
+    }
+    var form = await request.ReadFormAsync();
+    using var archive = new ZipArchive(form.Files[0].OpenReadStream());
+    using var nuspec = archive.Entries.Single(e => !e.FullName.Contains('/') && e.FullName.EndsWith(".nuspec")).Open();
+    var metadata = XDocument.Load(nuspec).Descendants().Where(e => e.Parent?.Name.LocalName == "metadata").ToList();
+    var package = metadata.First(e => e.Name.LocalName == "id").Value + " " + metadata.First(e => e.Name.LocalName == "version").Value;
+    lock (pushed)
+    {
+        if (pushed.Contains(package))
+        {
+            return Results.Conflict();
+        }
+        pushed.Add(package);
+    }
+    return Results.Created();
+});
+app.MapGet("/packages", () => string.Join("\n", pushed));
+app.Run();
+`).
+		WithExec([]string{"dotnet", "publish", "--output", "/app"}).
+		WithEnvVariable("ASPNETCORE_URLS", "http://+:8080").
+		WithExposedPort(8080).
+		WithDefaultArgs([]string{"dotnet", "/app/Nuget.dll"}).
+		AsService()
+	feed := "http://nuget:8080/v3/index.json"
+
+	lib := dag.Container().
+		From("mcr.microsoft.com/dotnet/sdk:10.0-alpine@sha256:940f919ae84dd92ccd4aab7686fa5b777870b006c9360351039e16bcaad73d89").
+		WithWorkdir("/src").
+		WithExec([]string{"dotnet", "new", "classlib", "--name", "TestLib", "--output", "TestLib"}).
+		WithExec([]string{"dotnet", "new", "sln", "--name", "Test", "--format", "sln"}).
+		WithExec([]string{"dotnet", "sln", "add", "TestLib"}).
+		Directory("/src")
+
+	mod := m.module()
+	_, err := mod.WithCred("nuget", feed, "", dag.SetSecret("nuget-api-key", "test-key"))
+	if err != nil {
+		return "", err
+	}
+	d, err := mod.Dotnet(ctx, "", "Release", "", nil, lib)
+	if err != nil {
+		return "", err
+	}
+	d, err = d.Restore(ctx, "**/*.csproj", nil, "*.sln")
+	if err != nil {
+		return "", err
+	}
+	d, err = d.Build(ctx, false).Pack(ctx, true, false, "1.2.3")
+	if err != nil {
+		return "", err
+	}
+	d.Base = d.Base.WithServiceBinding("nuget", nuget)
+
+	// The second push must succeed as the version already exists
+	for range 2 {
+		packages, err := d.PushPackages(ctx, "", feed)
+		if err != nil {
+			return "", err
+		}
+		if len(packages) != 1 || packages[0].Id != "TestLib" || packages[0].Version != "1.2.3" {
+			return "", fmt.Errorf("unexpected packages pushed: %v", packages)
+		}
+	}
+
+	out, err := dag.Container().
+		From("docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b").
+		WithServiceBinding("nuget", nuget).
+		WithExec([]string{"wget", "-qO-", "http://nuget:8080/packages"}).
+		Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+	if out != "TestLib 1.2.3" {
+		return "", fmt.Errorf("feed has %q, want the package once", out)
+	}
+	return out, nil
+}
+
+// Resolve the feed and cred to push packages to, and read package metadata from nuspecs
+func (m *Testing) NugetSource(
+	ctx context.Context,
+) (string, error) {
+	creds := []*Cred{
+		{Name: "owner", Url: "ghcr.io", UserId: "user"},
+		{Name: "feed", Url: "https://nuget.example.com/v3/index.json", UserId: "user"},
+		{Name: "docker", Url: "docker.io", UserId: "user"},
+	}
+	sources := []struct {
+		fromCred string
+		source   string
+		cred     string
+		want     string
+	}{
+		{"owner", "", "owner", "https://nuget.pkg.github.com/owner/index.json"},
+		{"feed", "", "feed", "https://nuget.example.com/v3/index.json"},
+		{"docker", "https://nuget.example.com/other/index.json", "docker", "https://nuget.example.com/other/index.json"},
+		{"", "https://nuget.example.com/v3/index.json/", "feed", "https://nuget.example.com/v3/index.json/"},
+		{"", "https://public.example.com/index.json", "", "https://public.example.com/index.json"},
+	}
+	for _, s := range sources {
+		cred, source, err := pushSource(creds, s.fromCred, s.source)
+		if err != nil {
+			return "", fmt.Errorf("pushSource(%q, %q): %w", s.fromCred, s.source, err)
+		}
+		name := ""
+		if cred != nil {
+			name = cred.Name
+		}
+		if name != s.cred || source != s.want {
+			return "", fmt.Errorf("pushSource(%q, %q) = %s, %s, want %s, %s", s.fromCred, s.source, name, source, s.cred, s.want)
+		}
+	}
+	for _, s := range [][2]string{{"docker", ""}, {"", ""}, {"missing", ""}, {"", "ftp://example.com/index.json"}} {
+		if _, _, err := pushSource(creds, s[0], s[1]); err == nil {
+			return "", fmt.Errorf("pushSource(%q, %q) should fail", s[0], s[1])
+		}
+	}
+
+	p, err := parseNuspec(`<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://schemas.microsoft.com/packaging/2013/05/nuspec.xsd">
+  <metadata>
+    <id>TestLib</id>
+    <version>1.2.3-rc.1</version>
+    <authors>TestLib</authors>
+  </metadata>
+</package>`)
+	if err != nil {
+		return "", err
+	}
+	if *p != (NugetPackage{Id: "TestLib", Version: "1.2.3-rc.1"}) {
+		return "", fmt.Errorf("parsed %+v from nuspec", *p)
+	}
+	if _, err := parseNuspec("<package><metadata /></package>"); err == nil {
+		return "", fmt.Errorf("nuspec without id should fail")
+	}
+
+	return "ok", nil
+}
+
+// NuGet credentials are available at exec time but never written to the base filesystem
+func (m *Testing) NugetSecret(
+	ctx context.Context,
+) (string, error) {
+	mod := m.module()
+	d, err := mod.Dotnet(ctx, "", "Release", "", nil, dag.Directory())
+	if err != nil {
+		return "", err
+	}
+	d, err = d.WithNuget(ctx, "https://nuget.example.com/v3/index.json", "test", "user", dag.SetSecret("nuget-token", "super-secret-token"))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = d.Base.
+		WithExec(inSh(`test "$NuGetPackageSourceCredentials_test" = "Username=user;Password=super-secret-token"`)).
+		Sync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("credentials not available at exec time: %w", err)
+	}
+
+	return dag.Container().
+		From("docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b").
+		WithMountedDirectory("/rootfs", d.Base.Rootfs()).
+		WithExec(inSh(`grep -q nuget.example.com "/rootfs$1" && ! grep -rlF super-secret-token /rootfs`, NUGETCONFIG)).
+		File("/rootfs" + NUGETCONFIG).
+		Contents(ctx)
+}
+
+// Run a test project that reaches a sidecar service through an environment variable
+func (m *Testing) DotnetTestServices(
+	ctx context.Context,
+) (string, error) {
+	sidecar := dag.Container().
+		From("docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b").
+		WithExec([]string{"apk", "add", "--no-cache", "busybox-extras"}).
+		WithNewFile("/www/index.html", "ok").
+		WithExposedPort(8080).
+		WithDefaultArgs([]string{"busybox-extras", "httpd", "-f", "-p", "8080", "-h", "/www"}).
+		AsService()
+
+	tests := dag.Container().
+		From("mcr.microsoft.com/dotnet/sdk:10.0-alpine@sha256:940f919ae84dd92ccd4aab7686fa5b777870b006c9360351039e16bcaad73d89").
+		WithWorkdir("/src").
+		WithExec([]string{"dotnet", "new", "xunit", "--name", "Tests", "--output", "Tests"}).
+		WithExec([]string{"rm", "Tests/UnitTest1.cs"}).
+		WithNewFile("Tests/SidecarTests.cs", `namespace Tests;
+
+public class SidecarTests
+{
+    [Fact]
+    public async Task SidecarIsReachable()
+    {
+        var url = Environment.GetEnvironmentVariable("SIDECAR_URL");
+        Assert.NotNull(url);
+        using var client = new HttpClient();
+        Assert.Equal("ok", await client.GetStringAsync(url));
+    }
+}
+`).
+		WithExec([]string{"dotnet", "new", "sln", "--name", "Tests", "--format", "sln"}).
+		WithExec([]string{"dotnet", "sln", "add", "Tests"}).
+		Directory("/src")
+
+	mod := m.module()
+	d, err := mod.Dotnet(ctx, "", "Release", "", nil, tests)
+	if err != nil {
+		return "", err
+	}
+	d, err = d.WithTestService(ctx, "sidecar", sidecar)
+	if err != nil {
+		return "", err
+	}
+	d, err = d.WithTestEnvVariable(ctx, "SIDECAR_URL", "http://sidecar:8080/")
+	if err != nil {
+		return "", err
+	}
+	d, err = d.Restore(ctx, "**/*.csproj", nil, "*.sln")
+	if err != nil {
+		return "", err
+	}
+	results, err := d.Build(ctx, false).Test(ctx, false, true, 0)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d of %d test(s) passed", results.Passed, results.Total), nil
+}
+
+// Build a web app image and smoke test it with probes
+func (m *Testing) DotnetSmokeTest(
+	ctx context.Context,
+) (string, error) {
+	mod := m.module()
+	d, err := mod.Dotnet(ctx, "", "Release", "Web", nil, dotnetWebApp())
+	if err != nil {
+		return "", err
+	}
+	d, err = d.Restore(ctx, "**/*.csproj", nil, "*.sln")
+	if err != nil {
+		return "", err
+	}
+	d, err = d.Build(ctx, false).Publish(ctx, "framework-dependent", false, "")
+	if err != nil {
+		return "", err
+	}
+
+	return d.SmokeTest(ctx, "/healthz", 8080, []string{"/=200", "/missing=404"}, "", "60s")
+}
+
+// Check shell-word parsing, validation, and that built arguments reach exec unchanged
+func (m *Testing) Command(
+	ctx context.Context,
+) (string, error) {
+	words := []struct {
+		in   string
+		want []string
+	}{
+		{``, []string{}},
+		{`--set a=b`, []string{"--set", "a=b"}},
+		{`  --atomic   --wait `, []string{"--atomic", "--wait"}},
+		{`--set 'a=b c'`, []string{"--set", "a=b c"}},
+		{`--set "a=b c"`, []string{"--set", "a=b c"}},
+		{`"x\"y" 'x"y'`, []string{`x"y`, `x"y`}},
+		{`a\ b`, []string{"a b"}},
+		{`'a;b' "c|d"`, []string{"a;b", "c|d"}},
+		{`'$HOME' \$HOME`, []string{"$HOME", "$HOME"}},
+		{`''`, []string{""}},
+	}
+	for _, w := range words {
+		got, err := shellWords(w.in)
+		if err != nil {
+			return "", fmt.Errorf("shellWords(%q): %w", w.in, err)
+		}
+		if !slices.Equal(got, w.want) {
+			return "", fmt.Errorf("shellWords(%q) = %q, want %q", w.in, got, w.want)
+		}
+	}
+
+	for _, in := range []string{`test; rm -rf /`, `a && b`, `a | b`, `$(id)`, "`id`", `"$HOME"`, `> out`, `'unterminated`, `trailing\`} {
+		if _, err := shellWords(in); err == nil {
+			return "", fmt.Errorf("shellWords(%q) should fail", in)
+		}
+	}
+
+	invalid := []error{
+		validateDnsLabel("namespace", "test; rm -rf /"),
+		validateDnsLabel("release name", "Test"),
+		validateIdentifier("source name", "feed $(id)"),
+		validateUrl("feed", "https://example.com/index.json; rm -rf /"),
+		validateUrl("feed", "file:///etc/passwd"),
+		validateDuration("timeout", "300"),
+		validateKubernetesVersion("1.29; id"),
+	}
+	for i, err := range invalid {
+		if err == nil {
+			return "", fmt.Errorf("invalid value %d passed validation", i)
+		}
+	}
+	if err := errors.Join(
+		validateDnsLabel("namespace", "testing-0"),
+		validateIdentifier("source name", "github.com"),
+		validateUrl("feed", "https://nuget.pkg.github.com/owner/index.json"),
+		validateDuration("timeout", "300s"),
+		validateKubernetesVersion("1.29"),
+	); err != nil {
+		return "", err
+	}
+
+	args, err := newCommand("printf", `%s\n`).
+		withFlag("set", "a=b c").
+		withShellWords(`'x; y' "\$z"`).
+		build()
+	if err != nil {
+		return "", err
+	}
+	out, err := dag.Container().
+		From("docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b").
+		WithExec(args).
+		Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+	if want := "--set=a=b c\nx; y\n$z\n"; out != want {
+		return "", fmt.Errorf("exec output %q, want %q", out, want)
+	}
+
+	_, err = newCommand("helm").withShellWords(`test; rm -rf /`).build()
+	if err == nil {
+		return "", fmt.Errorf("shell operators should be rejected")
+	}
+	return fmt.Sprintf("rejected: %v", err), nil
+}
+
+// Check image reference parsing, tag selection, and in-place replacement of compose images
+func (m *Testing) ComposeImages(
+	ctx context.Context,
+) (string, error) {
+	digest := "sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b"
+	refs := []struct {
+		in   string
+		want imageRef
+	}{
+		{"postgres:16", imageRef{Name: "postgres", Registry: "docker.io", Repository: "library/postgres", Tag: "16"}},
+		{"bitnami/postgresql:16.1.0", imageRef{Name: "bitnami/postgresql", Registry: "docker.io", Repository: "bitnami/postgresql", Tag: "16.1.0"}},
+		{"ghcr.io/owner/group/app:1.2.3", imageRef{Name: "ghcr.io/owner/group/app", Registry: "ghcr.io", Repository: "owner/group/app", Tag: "1.2.3"}},
+		{"localhost:5000/app:1.0", imageRef{Name: "localhost:5000/app", Registry: "localhost:5000", Repository: "app", Tag: "1.0"}},
+		{"registry.example.com:5000/team/app", imageRef{Name: "registry.example.com:5000/team/app", Registry: "registry.example.com:5000", Repository: "team/app"}},
+		{"postgres:16@" + digest, imageRef{Name: "postgres", Registry: "docker.io", Repository: "library/postgres", Tag: "16", Digest: digest}},
+		{"ghcr.io/owner/app@" + digest, imageRef{Name: "ghcr.io/owner/app", Registry: "ghcr.io", Repository: "owner/app", Digest: digest}},
+	}
+	for _, r := range refs {
+		got, err := parseImageRef(r.in)
+		if err != nil {
+			return "", fmt.Errorf("parseImageRef(%q): %w", r.in, err)
+		}
+		if *got != r.want {
+			return "", fmt.Errorf("parseImageRef(%q) = %+v, want %+v", r.in, *got, r.want)
+		}
+		if s := got.with(got.Tag, got.Digest); s != r.in {
+			return "", fmt.Errorf("parseImageRef(%q) written back as %q", r.in, s)
+		}
+	}
+	for _, in := range []string{"Postgres:16", "app:", "app@sha256:0123", "ghcr.io//app:1"} {
+		if _, err := parseImageRef(in); err == nil {
+			return "", fmt.Errorf("parseImageRef(%q) should fail", in)
+		}
+	}
+
+	tags := []struct {
+		current    string
+		constraint string
+		tags       []string
+		want       string
+	}{
+		{"16.1", "<17", []string{"16.2", "17.0", "16.2-alpine", "v16.3", "16.10", "16.3.1"}, "16.10"},
+		{"16.1-alpine", ">=16", []string{"16.2", "16.2-alpine", "16.3-bookworm"}, "16.2-alpine"},
+		{"16", ">=16", []string{"16.2", "17", "18", "latest"}, "18"},
+		{"v1.2.3", ">=1", []string{"1.2.4", "v1.2.4"}, "v1.2.4"},
+		{"1.2.3", "<1.2.3", []string{"1.2.4", "1.3.0"}, "1.2.3"},
+	}
+	for _, t := range tags {
+		current, ok := parseTagVersion(t.current)
+		if !ok {
+			return "", fmt.Errorf("parseTagVersion(%q) failed", t.current)
+		}
+		constraint, err := semver.NewConstraint(t.constraint)
+		if err != nil {
+			return "", err
+		}
+		if got := selectTag(t.current, current, t.tags, constraint); got != t.want {
+			return "", fmt.Errorf("selectTag(%q, %q) = %q, want %q", t.current, t.constraint, got, t.want)
+		}
+	}
+
+	policies := []struct {
+		policy  string
+		current string
+		allowed []string
+		denied  []string
+	}{
+		{"patch", "1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.3.0", "1.2.2"}},
+		{"minor", "1.2.3", []string{"1.9.0"}, []string{"2.0.0", "1.2.2"}},
+		{"minor", "0.13.1", []string{"0.13.9"}, []string{"0.14.0", "0.99.0", "1.0.0"}},
+		{"major", "0.13.1", []string{"0.99.0", "3.0.0"}, []string{"0.13.0"}},
+		{">=16 <18", "16.1.0", []string{"17.9.0"}, []string{"18.0.0"}},
+	}
+	for _, p := range policies {
+		constraint, err := policyConstraint(p.policy, semver.MustParse(p.current))
+		if err != nil {
+			return "", err
+		}
+		for _, v := range p.allowed {
+			if !constraint.Check(semver.MustParse(v)) {
+				return "", fmt.Errorf("policy %s from %s should allow %s", p.policy, p.current, v)
+			}
+		}
+		for _, v := range p.denied {
+			if constraint.Check(semver.MustParse(v)) {
+				return "", fmt.Errorf("policy %s from %s should deny %s", p.policy, p.current, v)
+			}
+		}
+	}
+
+	contents := strings.Join([]string{
+		"services:",
+		"  db:",
+		"    image: postgres:16 # pinned by hand",
+		"  app:",
+		`    image: "ghcr.io/owner/app:1.0"`,
+		"  cache:",
+		"    image: 'localhost:5000/cache:2'",
+		"",
+	}, "\n")
+	images, err := composeImages(contents)
+	if err != nil {
+		return "", err
+	}
+	if len(images) != 3 {
+		return "", fmt.Errorf("found %d images, want 3", len(images))
+	}
+	lines := strings.Split(contents, "\n")
+	for _, image := range images {
+		ref, err := parseImageRef(image.node.Value)
+		if err != nil {
+			return "", err
+		}
+		if err := replaceScalar(lines, image.node, ref.with(ref.Tag+".1", digest)); err != nil {
+			return "", err
+		}
+	}
+	want := strings.Join([]string{
+		"services:",
+		"  db:",
+		"    image: postgres:16.1@" + digest + " # pinned by hand",
+		"  app:",
+		`    image: "ghcr.io/owner/app:1.0.1@` + digest + `"`,
+		"  cache:",
+		"    image: 'localhost:5000/cache:2.1@" + digest + "'",
+		"",
+	}, "\n")
+	if got := strings.Join(lines, "\n"); got != want {
+		return "", fmt.Errorf("replaced compose file:\n%s\nwant:\n%s", got, want)
+	}
+
+	return "ok", nil
+}
+
+// Pin digests and keep existing pins in sync against a local registry
+func (m *Testing) ComposeDigests(
+	ctx context.Context,
+) ([]*ImageChange, error) {
+	registry, err := dag.Container().
+		From("docker.io/library/registry:3.1.1@sha256:1be55279f18a2fe1a74edf2664cac61c1bea305b7b4642dab412e7affdcb3e33").
+		WithExposedPort(5000).
+		AsService().
+		Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer registry.Stop(ctx)
+
+	compose := m.module().Compose(ctx)
+	compose.Container = compose.Container.
+		WithServiceBinding("registry", registry).
+		WithNewFile("/etc/containers/registries.conf.d/test.conf", "[[registry]]\nlocation = \"registry:5000\"\ninsecure = true\n")
+
+	// The registry starts empty, so the pushes must never be cached
+	c := compose.Container.
+		WithEnvVariable("CACHE_BUST", time.Now().String()).
+		WithExec([]string{"skopeo", "copy", "--all", "docker://docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b", "docker://registry:5000/app:1.0.0"}).
+		WithExec([]string{"skopeo", "copy", "--all", "docker://docker.io/library/registry:3.1.1@sha256:1be55279f18a2fe1a74edf2664cac61c1bea305b7b4642dab412e7affdcb3e33", "docker://registry:5000/app:1.1.0"})
+	old, err := resolveDigest(ctx, c, "registry:5000/app:1.0.0", "")
+	if err != nil {
+		return nil, err
+	}
+	latest, err := resolveDigest(ctx, c, "registry:5000/app:1.1.0", "")
+	if err != nil {
+		return nil, err
+	}
+
+	file := dag.File("compose.yaml", strings.Join([]string{
+		"services:",
+		"  stale:",
+		"    image: registry:5000/app:1.0.0@" + old,
+		"  moved:",
+		"    image: registry:5000/app:1.1.0@" + old,
+		"  pinned:",
+		"    image: registry:5000/app:1.1.0@" + latest,
+		"  unpinned:",
+		"    image: registry:5000/app:1.0.0",
+		"",
+	}, "\n"))
+	update, err := compose.UpdateImages(ctx, file, false, "", "minor")
+	if err != nil {
+		return nil, err
+	}
+
+	want := []ImageChange{
+		{Service: "stale", From: "registry:5000/app:1.0.0@" + old, To: "registry:5000/app:1.1.0@" + latest},
+		{Service: "moved", From: "registry:5000/app:1.1.0@" + old, To: "registry:5000/app:1.1.0@" + latest},
+		{Service: "pinned", From: "registry:5000/app:1.1.0@" + latest, SkippedReason: "up to date"},
+		{Service: "unpinned", From: "registry:5000/app:1.0.0", To: "registry:5000/app:1.1.0"},
+	}
+	if len(update.Changes) != len(want) {
+		return nil, fmt.Errorf("%d changes, want %d", len(update.Changes), len(want))
+	}
+	for i, w := range want {
+		if *update.Changes[i] != w {
+			return nil, fmt.Errorf("change %d = %+v, want %+v", i, *update.Changes[i], w)
+		}
+	}
+	return update.Changes, nil
+}
+
+// Check publish mode validation, publish arguments, and runtime identifiers
+func (m *Testing) PublishModes(
+	ctx context.Context,
+) (string, error) {
+	invalid := []struct {
+		mode     string
+		trim     bool
+		trimMode string
+	}{
+		{"framework-dependent", true, ""},
+		{"framework-dependent", false, "full"},
+		{"portable", false, ""},
+		{"self-contained", true, "aggressive"},
+	}
+	for _, i := range invalid {
+		d := &Dotnet{EntrypointProjects: []string{"App"}}
+		if _, err := d.Publish(ctx, i.mode, i.trim, i.trimMode); err == nil {
+			return "", fmt.Errorf("publish %s with trim %t and trim mode %q should fail", i.mode, i.trim, i.trimMode)
+		}
+	}
+	if _, err := (&Dotnet{}).Publish(ctx, "framework-dependent", false, ""); err == nil {
+		return "", fmt.Errorf("publish without entrypoint project should fail")
+	}
+
+	modes := []struct {
+		d       *Dotnet
+		runtime string
+		want    []string
+		denied  []string
+	}{
+		{&Dotnet{PublishMode: "framework-dependent"}, "linux-musl-arm", []string{"--runtime linux-musl-arm", "--self-contained false", "/p:UseAppHost=false"}, []string{"/p:PublishTrimmed=true"}},
+		{&Dotnet{PublishMode: "self-contained", Trim: true, TrimMode: "partial"}, "linux-musl-x64", []string{"--runtime linux-musl-x64", "--self-contained true", "/p:PublishTrimmed=true", "/p:TrimMode=partial"}, []string{"/p:PublishSingleFile=true"}},
+		{&Dotnet{PublishMode: "single-file"}, "linux-musl-arm64", []string{"--self-contained true", "/p:PublishSingleFile=true"}, []string{"/p:PublishTrimmed=true"}},
+		{&Dotnet{PublishMode: "native-aot"}, "linux-musl-x64", []string{"/p:PublishAot=true"}, []string{"--self-contained false"}},
+	}
+	for _, mode := range modes {
+		mode.d.Configuration = "Release"
+		args := " " + strings.Join(mode.d.publishArgs("App", mode.runtime), " ") + " "
+		for _, want := range append(mode.want, "--output "+appDir("App")) {
+			if !strings.Contains(args, " "+want+" ") {
+				return "", fmt.Errorf("%s arguments%s are missing %s", mode.d.PublishMode, args, want)
+			}
+		}
+		for _, denied := range mode.denied {
+			if strings.Contains(args, " "+denied+" ") {
+				return "", fmt.Errorf("%s arguments%s should not contain %s", mode.d.PublishMode, args, denied)
+			}
+		}
+	}
+
+	runtimes := map[dagger.Platform]string{
+		"linux/amd64":   "linux-musl-x64",
+		"linux/arm64":   "linux-musl-arm64",
+		"linux/arm":     "linux-musl-arm",
+		"linux/arm/v7":  "linux-musl-arm",
+		"linux/arm/v6":  "",
+		"windows/amd64": "",
+	}
+	for platform, want := range runtimes {
+		got, err := runtimeIdentifier(platform)
+		if want == "" && err == nil || want != "" && got != want {
+			return "", fmt.Errorf("runtimeIdentifier(%s) = %q, %v, want %q", platform, got, err, want)
+		}
+	}
+
+	return "ok", nil
+}
+
+// Check which files of a solution are part of the restore layer
+func (m *Testing) RestoreInputs(
+	ctx context.Context,
+) (string, error) {
+	included := []string{
+		"App.sln",
+		"App.slnx",
+		"global.json",
+		"nuget.config",
+		"Directory.Build.props",
+		"Directory.Packages.props",
+		"src/App/App.csproj",
+		"src/App/" + LOCKFILE,
+		"src/App/Directory.Build.targets",
+		"src/App/NuGet.Config",
+		"build/Custom.targets",
+	}
+	excluded := []string{
+		"README.md",
+		"src/App/Program.cs",
+		"src/App/appsettings.json",
+		"src/App/bin/App.dll",
+	}
+	source := dag.Directory()
+	for _, file := range slices.Concat(included, excluded) {
+		source = source.WithNewFile(file, file)
+	}
+
+	files, err := dag.Directory().
+		WithDirectory(".", source, dagger.DirectoryWithDirectoryOpts{Include: restoreIncludes("**/*.csproj", "*.sln", []string{"**/*.targets"})}).
+		Glob(ctx, "**/*.*")
+	if err != nil {
+		return "", err
+	}
+	slices.Sort(files)
+	slices.Sort(included)
+	if !slices.Equal(files, included) {
+		return "", fmt.Errorf("restore inputs = %v, want %v", files, included)
+	}
+
+	return "ok", nil
+}
+
+// Pick the SDK channel from overrides, global.json roll forward policies and target frameworks
+func (m *Testing) SdkChannel(
+	ctx context.Context,
+) (string, error) {
+	global := func(version, policy string) string {
+		return fmt.Sprintf(`{"sdk": {"version": %q, "rollForward": %q}}`, version, policy)
+	}
+	channels := []struct {
+		override   string
+		globalJson string
+		frameworks []string
+		want       string
+	}{
+		{"", "", nil, DEFAULT_DOTNET_CHANNEL},
+		{"", "", []string{"netstandard2.0"}, DEFAULT_DOTNET_CHANNEL},
+		{"", "", []string{"net6.0"}, "8.0"},
+		{"", "", []string{"net8.0", "net9.0-windows"}, "9.0"},
+		{"", "", []string{"net11.0"}, ""},
+		{"9.0", "", []string{"net8.0"}, "9.0"},
+		{"8.0", "", []string{"net9.0"}, ""},
+		{"6.0", "", []string{"net6.0"}, ""},
+		{"9.0", global("8.0.100", "patch"), nil, "9.0"},
+		{"", `{}`, []string{"net9.0"}, "9.0"},
+		{"", `{"sdk": `, nil, ""},
+		{"", global("8.0.100", ""), nil, "8.0"},
+		{"", global("8.0.100", "patch"), nil, "8.0"},
+		{"", global("8.0.100", "patch"), []string{"net9.0"}, ""},
+		{"", global("8.0.400", "feature"), nil, "8.0"},
+		{"", global("8.0.100", "minor"), nil, "8.0"},
+		{"", global("6.0.100", "minor"), nil, ""},
+		{"", global("6.0.100", "major"), nil, "8.0"},
+		{"", global("8.0.100", "major"), []string{"net9.0"}, "9.0"},
+		{"", global("8.0.100", "latestMinor"), nil, "8.0"},
+		{"", global("8.0.100", "latestMajor"), nil, "10.0"},
+		{"", global("8.0.100", "sideways"), nil, ""},
+		{"", global("eight", "patch"), nil, ""},
+	}
+	for _, c := range channels {
+		got, err := sdkChannel(c.override, c.globalJson, c.frameworks)
+		if c.want == "" && err == nil || c.want != "" && (err != nil || got != c.want) {
+			return "", fmt.Errorf("sdkChannel(%q, %q, %v) = %q, %v, want %q", c.override, c.globalJson, c.frameworks, got, err, c.want)
+		}
+	}
+
+	rolls := []struct {
+		version string
+		policy  string
+		minimum string
+		want    string
+	}{
+		{"9.0.100", "patch", "", "9.0"},
+		{"9.0.300", "latestFeature", "", "9.0"},
+		{"9.0.100", "disable", "", "9.0"},
+		{"7.0.100", "patch", "", ""},
+		{"7.0.100", "minor", "", ""},
+		{"7.0.100", "major", "", "8.0"},
+		{"7.0.100", "major", "9.0", "9.0"},
+		{"7.0.100", "latestMajor", "", "10.0"},
+		{"10.0.100", "latestMajor", "", "10.0"},
+		{"9.0.100", "minor", "10.0", ""},
+	}
+	for _, r := range rolls {
+		got, err := rollForward(r.version, r.policy, r.minimum)
+		if r.want == "" && err == nil || r.want != "" && (err != nil || got != r.want) {
+			return "", fmt.Errorf("rollForward(%q, %q, %q) = %q, %v, want %q", r.version, r.policy, r.minimum, got, err, r.want)
+		}
+	}
+
+	return "ok", nil
+}
+
+// Merge Cobertura reports and check line coverage against thresholds above and below it
+func (m *Testing) Coverage(
+	ctx context.Context,
+) (string, error) {
+	cobertura := func(assembly string, hits ...int) string {
+		lines := ""
+		covered := 0
+		for i, h := range hits {
+			lines += fmt.Sprintf("<line number=\"%d\" hits=\"%d\" branch=\"False\" />", i+1, h)
+			if h > 0 {
+				covered++
+			}
+		}
+		rate := float64(covered) / float64(len(hits))
+		return fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<coverage line-rate="%[1]g" branch-rate="1" version="1.9" timestamp="1700000000" lines-covered="%[2]d" lines-valid="%[3]d" branches-covered="0" branches-valid="0">
+  <sources><source>/src/</source></sources>
+  <packages>
+    <package name="%[4]s" line-rate="%[1]g" branch-rate="1" complexity="1">
+      <classes>
+        <class name="%[4]s.Code" filename="%[4]s/Code.cs" line-rate="%[1]g" branch-rate="1" complexity="1">
+          <methods />
+          <lines>%[5]s</lines>
+        </class>
+      </classes>
+    </package>
+  </packages>
+</coverage>`, rate, covered, len(hits), assembly, lines)
+	}
+	results := dag.Directory().
+		WithNewFile("a/coverage.cobertura.xml", cobertura("Calc", 1, 3, 0)).
+		WithNewFile("b/coverage.cobertura.xml", cobertura("Util", 0))
+
+	mod := m.module()
+	d, err := mod.Dotnet(ctx, "", "Release", "", nil, dag.Directory())
+	if err != nil {
+		return "", err
+	}
+	r := &TestResults{}
+	if err := d.mergeCoverage(ctx, results, r); err != nil {
+		return "", err
+	}
+
+	if math.Abs(r.LineCoverage-50) > 0.01 {
+		return "", fmt.Errorf("merged line coverage %v, want 50", r.LineCoverage)
+	}
+	assemblies := []string{}
+	for _, a := range r.CoverageByAssembly {
+		assemblies = append(assemblies, fmt.Sprintf("%s %.2f", a.Name, a.LineCoverage))
+	}
+	if want := []string{"Calc 66.67", "Util 0.00"}; !slices.Equal(assemblies, want) {
+		return "", fmt.Errorf("coverage per assembly %v, want %v", assemblies, want)
+	}
+	if _, err := r.Coverage.File("index.html").Sync(ctx); err != nil {
+		return "", fmt.Errorf("HTML report missing: %w", err)
+	}
+
+	r.MinLineCoverage = 40
+	if err := r.checkCoverage(); err != nil {
+		return "", fmt.Errorf("coverage above the threshold should pass: %w", err)
+	}
+	r.MinLineCoverage = 60
+	err = r.checkCoverage()
+	if err == nil || !strings.Contains(err.Error(), "Util: 0.00% (below threshold)") || strings.Contains(err.Error(), "Calc: 66.67% (below") {
+		return "", fmt.Errorf("coverage below the threshold should fail with the assemblies below it, got %v", err)
+	}
+	if err := (&TestResults{MinLineCoverage: 60}).checkCoverage(); err == nil {
+		return "", fmt.Errorf("a threshold without coverage should fail")
+	}
+
+	return err.Error(), nil
+}
+
+// Check the summary and JUnit conversion of a TRX test run
+func (m *Testing) Trx(
+	ctx context.Context,
+) (string, error) {
+	durations := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"00:00:01.5000000", 1500 * time.Millisecond},
+		{"01:02:03", time.Hour + 2*time.Minute + 3*time.Second},
+		{"00:01:00.2500000", time.Minute + 250*time.Millisecond},
+		{"", 0},
+		{"1.5s", 0},
+	}
+	for _, d := range durations {
+		if got := parseTrxDuration(d.in); got != d.want {
+			return "", fmt.Errorf("parseTrxDuration(%q) = %s, want %s", d.in, got, d.want)
+		}
+	}
+
+	fixture := `<?xml version="1.0" encoding="utf-8"?>
+<TestRun xmlns="http://microsoft.com/schemas/VisualStudio/TeamTest/2010">
+  <Results>
+    <UnitTestResult testId="a" testName="Adds" outcome="Passed" duration="00:00:00.2500000">
+      <Output><StdOut>hello</StdOut></Output>
+    </UnitTestResult>
+    <UnitTestResult testId="b" testName="Divides" outcome="Failed" duration="00:00:00.5000000">
+      <Output>
+        <ErrorInfo>
+          <Message> Expected 2 but was 3 </Message>
+          <StackTrace>at Calc.Tests.Divides()</StackTrace>
+        </ErrorInfo>
+      </Output>
+    </UnitTestResult>
+    <UnitTestResult testId="c" testName="Slow" outcome="NotExecuted" duration="00:00:00">
+      <Output><ErrorInfo><Message>Too slow</Message></ErrorInfo></Output>
+    </UnitTestResult>
+    <UnitTestResult testId="d" testName="Hangs" outcome="Timeout" duration="00:00:01.2500000" />
+  </Results>
+  <TestDefinitions>
+    <UnitTest id="a" storage="/src/test/bin/Release/net10.0/Calc.Tests.dll"><TestMethod className="Calc.Tests.Math" /></UnitTest>
+    <UnitTest id="b" storage="/src/test/bin/Release/net10.0/Calc.Tests.dll"><TestMethod className="Calc.Tests.Math" /></UnitTest>
+    <UnitTest id="c" storage="/src/test/bin/Release/net10.0/Calc.Tests.dll"><TestMethod className="Calc.Tests.Perf" /></UnitTest>
+    <UnitTest id="d" storage="/src/test/bin/Release/net10.0/Calc.Tests.dll"><TestMethod className="Calc.Tests.Perf" /></UnitTest>
+  </TestDefinitions>
+</TestRun>`
+	run := &trxTestRun{}
+	if err := xml.Unmarshal([]byte(fixture), run); err != nil {
+		return "", err
+	}
+	r := &TestResults{Failures: []*TestFailure{}}
+	suites := r.add(run, "results")
+
+	if r.Total != 4 || r.Passed != 1 || r.Failed != 2 || r.Skipped != 1 {
+		return "", fmt.Errorf("summary %d total, %d passed, %d failed, %d skipped, want 4, 1, 2, 1", r.Total, r.Passed, r.Failed, r.Skipped)
+	}
+	failures := []TestFailure{
+		{Name: "Divides", Message: "Expected 2 but was 3", StackTrace: "at Calc.Tests.Divides()"},
+		{Name: "Hangs", Message: "Timeout"},
+	}
+	if len(r.Failures) != len(failures) {
+		return "", fmt.Errorf("%d failures, want %d", len(r.Failures), len(failures))
+	}
+	for i, f := range failures {
+		if *r.Failures[i] != f {
+			return "", fmt.Errorf("failure %d = %+v, want %+v", i, *r.Failures[i], f)
+		}
+	}
+
+	b, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	junit := string(b)
+	for _, want := range []string{
+		`<testsuite name="Calc.Tests.dll" tests="4" failures="2" skipped="1" time="2">`,
+		`<testcase classname="Calc.Tests.Math" name="Adds" time="0.25">`,
+		`<system-out>hello</system-out>`,
+		`<failure message="Expected 2 but was 3">at Calc.Tests.Divides()</failure>`,
+		`<skipped message="Too slow"></skipped>`,
+		`<failure message="Timeout"></failure>`,
+	} {
+		if !strings.Contains(junit, want) {
+			return "", fmt.Errorf("JUnit XML is missing %s:\n%s", want, junit)
+		}
+	}
+
+	_, err = r.Assert(ctx)
+	if err == nil || !strings.Contains(err.Error(), "2 of 4 test(s) failed") || !strings.Contains(err.Error(), "Divides: Expected 2 but was 3") {
+		return "", fmt.Errorf("assert should list the failing tests, got %v", err)
+	}
+	_, err = (&TestResults{ExitCode: 1, Output: "restoring\nerror CS1002: ; expected\n"}).Assert(ctx)
+	if err == nil || !strings.HasSuffix(err.Error(), "error CS1002: ; expected") {
+		return "", fmt.Errorf("assert should show the output of a failed run, got %v", err)
+	}
+
+	return "ok", nil
+}
+
+// Resolve @version annotations against a local module proxy stand-in
+func (m *Testing) UpdateVersions(
+	ctx context.Context,
+) (string, error) {
+	hash := "0123456789abcdef0123456789abcdef01234567"
+	goproxy := dag.Container().
+		From("docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b").
+		WithExec([]string{"apk", "add", "--no-cache", "busybox-extras"}).
+		WithNewFile("/www/example.com/!tool/@v/list", "v1.2.0\nv1.2.5\nv1.3.0\nv2.0.0-rc.1\n").
+		WithNewFile("/www/example.com/!tool/@v/v1.2.5.info", fmt.Sprintf(`{"Version":"v1.2.5","Origin":{"VCS":"git","URL":"https://example.com/Tool","Ref":"refs/tags/v1.2.5","Hash":"%s"}}`, hash)).
+		WithNewFile("/www/example.com/!tool/@v/v1.3.0.info", `{"Version":"v1.3.0","Origin":{"VCS":"git","URL":"https://example.com/Tool","Ref":"refs/tags/v1.3.0","Hash":"fedcba9876543210fedcba9876543210fedcba98"}}`).
+		WithExposedPort(8080).
+		WithDefaultArgs([]string{"busybox-extras", "httpd", "-f", "-p", "8080", "-h", "/www"}).
+		AsService()
+
+	source := dag.Directory().WithNewFile("tools/tools.go", "package tools\n\n"+
+		"// @version policy=~1.2.0 resolved=v1.2.0\n"+
+		"var pinned = `go install example.com/Tool/cmd/tool@aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa`\n\n"+
+		"// @version policy=minor resolved=v1.2.0\n"+
+		"var tagged = `go install example.com/Tool/cmd/tool@v1.2.0`\n\n"+
+		"// @version policy=patch resolved=v1.3.0\n"+
+		"var current = `go install example.com/Tool/cmd/tool@v1.3.0`\n")
+
+	updated, err := updateVersions(ctx, versionsContainer().WithServiceBinding("goproxy", goproxy), source, "http://goproxy:8080")
+	if err != nil {
+		return "", err
+	}
+	contents, err := updated.File("tools/tools.go").Contents(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, want := range []string{
+		"// @version policy=~1.2.0 resolved=v1.2.5\n",
+		"example.com/Tool/cmd/tool@" + hash + "`",
+		"// @version policy=minor resolved=v1.3.0\n",
+		"example.com/Tool/cmd/tool@v1.3.0`\n\n// @version policy=patch",
+		"// @version policy=patch resolved=v1.3.0\n",
+	} {
+		if !strings.Contains(contents, want) {
+			return "", fmt.Errorf("expected %q in:\n%s", want, contents)
+		}
+	}
+
+	return contents, nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"dagger/mikael-elkiaer/internal/dagger"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Results of a test run
+type TestResults struct {
+	// TRX results in trx/ and their JUnit XML conversions in junit/
+	Directory *dagger.Directory
+	// Exit code of the test run
+	ExitCode int
+	// Output of the test run
+	Output string
+	Total    int
+	Passed   int
+	Failed   int
+	Skipped  int
+	// Failing tests with their messages
+	Failures []*TestFailure
+	// Merged Cobertura.xml and HTML report, if coverage was collected
+	Coverage *dagger.Directory
+	// Total line coverage in percent
+	LineCoverage float64
+	// Line coverage in percent per assembly
+	CoverageByAssembly []*AssemblyCoverage
+	// +private
+	MinLineCoverage float64
+}
+
+// Single failing test
+type TestFailure struct {
+	// Fully qualified name of the test
+	Name string
+	// Error message
+	Message string
+	// Stack trace of the error
+	StackTrace string
+}
+
+// Fail if any test failed, the test run itself failed, or coverage is below the threshold
+func (r *TestResults) Assert(
+	ctx context.Context,
+) (*TestResults, error) {
+	if r.Failed > 0 {
+		failures := make([]string, len(r.Failures))
+		for i, f := range r.Failures {
+			failures[i] = fmt.Sprintf("%s: %s", f.Name, f.Message)
+		}
+		return nil, fmt.Errorf("%d of %d test(s) failed:\n%s", r.Failed, r.Total, strings.Join(failures, "\n"))
+	}
+	if r.ExitCode != 0 {
+		return nil, fmt.Errorf("test run failed with exit code %d:\n%s", r.ExitCode, lastLines(r.Output, TEST_OUTPUT_LINES))
+	}
+	if err := r.checkCoverage(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Lines of test output shown when the test run fails without failing tests
+const TEST_OUTPUT_LINES = 50
+
+// Last n lines of the output
+func lastLines(
+	output string,
+	n int,
+) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Collect TRX files from a results directory and convert them to JUnit XML
+func newTestResults(
+	ctx context.Context,
+	results *dagger.Directory,
+	exitCode int,
+	output string,
+) (*TestResults, error) {
+	r := &TestResults{ExitCode: exitCode, Output: output, Failures: []*TestFailure{}}
+	dir := dag.Directory().WithDirectory("trx", results, dagger.DirectoryWithDirectoryOpts{Include: []string{"**/*.trx"}})
+
+	files, err := results.Glob(ctx, "**/*.trx")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		contents, err := results.File(file).Contents(ctx)
+		if err != nil {
+			return nil, err
+		}
+		run := &trxTestRun{}
+		if err := xml.Unmarshal([]byte(contents), run); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", file, err)
+		}
+
+		suite := r.add(run, strings.TrimSuffix(path.Base(file), ".trx"))
+		junit, err := xml.MarshalIndent(suite, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		dir = dir.WithNewFile(path.Join("junit", strings.TrimSuffix(file, ".trx")+".xml"), xml.Header+string(junit))
+	}
+
+	r.Directory = dir
+	return r, nil
+}
+
+// Add a test run to the summary and convert it to a JUnit test suite
+func (r *TestResults) add(
+	run *trxTestRun,
+	name string,
+) *junitTestSuites {
+	classNames := map[string]string{}
+	for _, def := range run.TestDefinitions {
+		classNames[def.Id] = def.TestMethod.ClassName
+		if def.Storage != "" {
+			name = path.Base(def.Storage)
+		}
+	}
+
+	suite := &junitTestSuite{Name: name}
+	for _, result := range run.Results {
+		duration := parseTrxDuration(result.Duration)
+		tc := &junitTestCase{
+			ClassName: classNames[result.TestId],
+			Name:      result.TestName,
+			Time:      duration.Seconds(),
+		}
+
+		r.Total++
+		suite.Tests++
+		suite.Time += duration.Seconds()
+		switch result.Outcome {
+		case "Passed":
+			r.Passed++
+		case "NotExecuted":
+			r.Skipped++
+			suite.Skipped++
+			tc.Skipped = &junitSkipped{Message: strings.TrimSpace(result.Output.ErrorInfo.Message)}
+		default:
+			r.Failed++
+			suite.Failures++
+			message := strings.TrimSpace(result.Output.ErrorInfo.Message)
+			if message == "" {
+				message = result.Outcome
+			}
+			r.Failures = append(r.Failures, &TestFailure{
+				Name:       result.TestName,
+				Message:    message,
+				StackTrace: strings.TrimSpace(result.Output.ErrorInfo.StackTrace),
+			})
+			tc.Failure = &junitFailure{Message: message, Text: result.Output.ErrorInfo.StackTrace}
+		}
+		if result.Output.StdOut != "" {
+			tc.SystemOut = result.Output.StdOut
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	return &junitTestSuites{TestSuites: []*junitTestSuite{suite}}
+}
+
+// TRX durations look like 00:00:01.2345678
+func parseTrxDuration(
+	s string,
+) time.Duration {
+	var h, m int
+	var sec float64
+	if _, err := fmt.Sscanf(s, "%d:%d:%f", &h, &m, &sec); err != nil {
+		return 0
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec*float64(time.Second))
+}
+
+type trxTestRun struct {
+	Results []struct {
+		TestId   string `xml:"testId,attr"`
+		TestName string `xml:"testName,attr"`
+		Outcome  string `xml:"outcome,attr"`
+		Duration string `xml:"duration,attr"`
+		Output   struct {
+			StdOut    string `xml:"StdOut"`
+			ErrorInfo struct {
+				Message    string `xml:"Message"`
+				StackTrace string `xml:"StackTrace"`
+			} `xml:"ErrorInfo"`
+		} `xml:"Output"`
+	} `xml:"Results>UnitTestResult"`
+	TestDefinitions []struct {
+		Id         string `xml:"id,attr"`
+		Storage    string `xml:"storage,attr"`
+		TestMethod struct {
+			ClassName string `xml:"className,attr"`
+		} `xml:"TestMethod"`
+	} `xml:"TestDefinitions>UnitTest"`
+}
+
+type junitTestSuites struct {
+	XMLName    xml.Name          `xml:"testsuites"`
+	TestSuites []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string           `xml:"name,attr"`
+	Tests     int              `xml:"tests,attr"`
+	Failures  int              `xml:"failures,attr"`
+	Skipped   int              `xml:"skipped,attr"`
+	Time      float64          `xml:"time,attr"`
+	TestCases []*junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr,omitempty"`
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"dagger/mikael-elkiaer/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// Update tools pinned next to @version annotations in Go source
+//
+// An annotation like `// @version policy=~0.4.0 resolved=0.4.0` applies to the
+// next `go install <package>@<ref>` within a few lines. The newest version
+// satisfying the policy is resolved from the Go module proxy, falling back to
+// git tags, and both `resolved=` and the ref are updated. Refs that are commit
+// hashes are replaced by the commit of the new version.
+func (m *MikaelElkiaer) UpdateVersions(
+	ctx context.Context,
+	// Go module proxy to resolve versions from
+	// +default="https://proxy.golang.org"
+	goproxy string,
+	// Directory containing the Go source
+	source *dagger.Directory,
+) (*dagger.Directory, error) {
+	if err := validateUrl("goproxy", goproxy); err != nil {
+		return nil, err
+	}
+	return updateVersions(ctx, versionsContainer(), source, goproxy)
+}
+
+func versionsContainer() *dagger.Container {
+	return dag.Container().
+		From("docker.io/library/alpine:3.24.1@sha256:28bd5fe8b56d1bd048e5babf5b10710ebe0bae67db86916198a6eec434943f8b").
+		WithExec([]string{"apk", "add", "--no-cache", "git"})
+}
+
+var (
+	versionAnnotation = regexp.MustCompile(`^\s*//\s*@version\s+(.*)$`)
+	goInstall         = regexp.MustCompile(`go install ([^\s@]+)@([^\s"'` + "`" + `]+)`)
+	commitHash        = regexp.MustCompile(`^[0-9a-f]{40}$`)
+)
+
+// Number of lines after an annotation to look for the go install
+const VERSION_LOOKAHEAD = 5
+
+func updateVersions(
+	ctx context.Context,
+	container *dagger.Container,
+	source *dagger.Directory,
+	goproxy string,
+) (*dagger.Directory, error) {
+	files, err := source.Glob(ctx, "**/*.go")
+	if err != nil {
+		return nil, err
+	}
+	// Versions are published upstream, so never reuse a cached lookup
+	container = container.WithEnvVariable("CACHE_BUST", time.Now().String())
+
+	for _, file := range files {
+		contents, err := source.File(file).Contents(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		lines := strings.Split(contents, "\n")
+		changed := false
+		for i, line := range lines {
+			match := versionAnnotation.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			attrs := annotationAttributes(match[1])
+
+			target := -1
+			for j := i + 1; j < len(lines) && j <= i+VERSION_LOOKAHEAD; j++ {
+				if goInstall.MatchString(lines[j]) {
+					target = j
+					break
+				}
+			}
+			if target < 0 {
+				return nil, fmt.Errorf("%s:%d: no go install found after @version annotation", file, i+1)
+			}
+			install := goInstall.FindStringSubmatch(lines[target])
+			pkg, ref := install[1], install[2]
+
+			resolved, err := resolveVersion(ctx, container, goproxy, pkg, attrs["policy"], attrs["resolved"])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file, i+1, err)
+			}
+			if resolved == nil {
+				continue
+			}
+
+			newRef := resolved.version
+			if commitHash.MatchString(ref) {
+				newRef = resolved.hash
+			}
+			lines[i] = strings.Replace(line, "resolved="+attrs["resolved"], "resolved="+resolved.version, 1)
+			lines[target] = strings.Replace(lines[target], pkg+"@"+ref, pkg+"@"+newRef, 1)
+			changed = true
+		}
+
+		if changed {
+			source = source.WithNewFile(file, strings.Join(lines, "\n"))
+		}
+	}
+
+	return source, nil
+}
+
+func annotationAttributes(
+	s string,
+) map[string]string {
+	attrs := map[string]string{}
+	for _, field := range strings.Fields(s) {
+		if k, v, ok := strings.Cut(field, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+type resolvedVersion struct {
+	// Version as published, e.g. v1.2.3 or 0.13.1-2
+	version string
+	// Commit of the version
+	hash string
+}
+
+// Newest version satisfying the policy, nil if none is newer than the current one
+func resolveVersion(
+	ctx context.Context,
+	container *dagger.Container,
+	goproxy string,
+	pkg string,
+	policy string,
+	current string,
+) (*resolvedVersion, error) {
+	if policy == "" {
+		return nil, fmt.Errorf("@version annotation for %s has no policy", pkg)
+	}
+	currentVersion, err := semver.NewVersion(current)
+	if err != nil {
+		return nil, fmt.Errorf("@version annotation for %s has invalid resolved version %q", pkg, current)
+	}
+	constraint, err := policyConstraint(policy, currentVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	module, versions, err := proxyVersions(ctx, container, goproxy, pkg)
+	if err != nil {
+		return nil, err
+	}
+	if version := newestVersion(versions, constraint, currentVersion); version != "" {
+		hash, err := proxyHash(ctx, container, goproxy, module, version)
+		if err != nil {
+			return nil, err
+		}
+		if hash == "" {
+			hash, err = gitTagHash(ctx, container, gitUrl(module), version)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &resolvedVersion{version: version, hash: hash}, nil
+	}
+
+	// The proxy is authoritative once it knows the current version, otherwise
+	// the version may be a tag that is not a valid module version, e.g. 0.13.1-2
+	if slices.Contains(versions, current) {
+		return nil, nil
+	}
+	url := gitUrl(pkg)
+	if module != "" {
+		url = gitUrl(module)
+	}
+	tags, err := gitTags(ctx, container, url)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(tags))
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	if version := newestVersion(names, constraint, currentVersion); version != "" {
+		return &resolvedVersion{version: version, hash: tags[version]}, nil
+	}
+
+	return nil, nil
+}
+
+func newestVersion(
+	versions []string,
+	constraint *semver.Constraints,
+	current *semver.Version,
+) string {
+	best := current
+	bestVersion := ""
+	for _, v := range versions {
+		version, err := semver.NewVersion(v)
+		if err != nil || !constraint.Check(version) || !version.GreaterThan(best) {
+			continue
+		}
+		best = version
+		bestVersion = v
+	}
+	return bestVersion
+}
+
+// Versions of the module providing the package, probing from the longest path
+func proxyVersions(
+	ctx context.Context,
+	container *dagger.Container,
+	goproxy string,
+	pkg string,
+) (string, []string, error) {
+	parts := strings.Split(pkg, "/")
+	for n := len(parts); n >= 1; n-- {
+		module := strings.Join(parts[:n], "/")
+		out, err := fetch(ctx, container, fmt.Sprintf("%s/%s/@v/list", goproxy, escapeModulePath(module)))
+		if err != nil {
+			return "", nil, err
+		}
+		if versions := strings.Fields(out); len(versions) > 0 {
+			return module, versions, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// Commit of a version from the proxy's origin metadata, empty if unknown
+func proxyHash(
+	ctx context.Context,
+	container *dagger.Container,
+	goproxy string,
+	module string,
+	version string,
+) (string, error) {
+	out, err := fetch(ctx, container, fmt.Sprintf("%s/%s/@v/%s.info", goproxy, escapeModulePath(module), version))
+	if err != nil || out == "" {
+		return "", err
+	}
+	info := struct {
+		Origin struct {
+			Hash string
+		}
+	}{}
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		return "", fmt.Errorf("unexpected info from proxy for %s@%s: %w", module, version, err)
+	}
+	return info.Origin.Hash, nil
+}
+
+// Body of a URL, empty if it is not found
+//
+// Only 404 and 410 mean not found, as returned by module proxies for unknown
+// modules. Other failures, e.g. DNS, TLS, or server errors, are returned.
+func fetch(
+	ctx context.Context,
+	container *dagger.Container,
+	url string,
+) (string, error) {
+	out, err := container.
+		WithExec(inSh(`
+wget -qO- "$1" 2>/tmp/wget.err && exit 0
+grep -Eq 'HTTP/[0-9.]+ (404|410)( |$)' /tmp/wget.err && exit 0
+cat /tmp/wget.err >&2
+exit 1`, url)).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("fetching %s: %w", url, err)
+	}
+	return out, nil
+}
+
+// Tags of a git repository with the commit they point to
+func gitTags(
+	ctx context.Context,
+	container *dagger.Container,
+	url string,
+) (map[string]string, error) {
+	out, err := container.
+		WithExec([]string{"git", "ls-remote", "--tags", url}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		hash, ref, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		tag := strings.TrimPrefix(ref, "refs/tags/")
+		// Annotated tags are listed twice, the peeled ^{} entry has the commit
+		if peeled, ok := strings.CutSuffix(tag, "^{}"); ok {
+			tags[peeled] = hash
+		} else if _, ok := tags[tag]; !ok {
+			tags[tag] = hash
+		}
+	}
+	return tags, nil
+}
+
+func gitTagHash(
+	ctx context.Context,
+	container *dagger.Container,
+	url string,
+	tag string,
+) (string, error) {
+	tags, err := gitTags(ctx, container, url)
+	if err != nil {
+		return "", err
+	}
+	hash, ok := tags[tag]
+	if !ok {
+		return "", fmt.Errorf("tag %s not found in %s", tag, url)
+	}
+	return hash, nil
+}
+
+// Repository URL of a module or package, e.g. https://github.com/owner/repo
+func gitUrl(
+	path string,
+) string {
+	parts := strings.Split(path, "/")
+	switch parts[0] {
+	case "github.com", "gitlab.com", "bitbucket.org":
+		if len(parts) > 3 {
+			parts = parts[:3]
+		}
+	}
+	return "https://" + strings.Join(parts, "/")
+}
+
+// Escape upper case letters as required by the module proxy protocol
+func escapeModulePath(
+	path string,
+) string {
+	var b strings.Builder
+	for _, r := range path {
+		if 'A' <= r && r <= 'Z' {
+			b.WriteRune('!')
+			b.WriteRune(r + ('a' - 'A'))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}